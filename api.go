@@ -0,0 +1,265 @@
+// Package carver normalizes the config files of several environments into the
+// values they share and the overrides of each environment, and merges them
+// back. The carver command is a thin wrapper around it.
+//
+//    tree, err := carver.LoadTree("config")
+//    normalized, err := carver.Normalize(ctx, tree, carver.Options{})
+//    report, err := normalized.Write(false)
+package carver
+
+import (
+    "context"
+    "io/fs"
+    "path"
+    "sort"
+)
+
+// a Tree is a config directory along with its .carver.yaml, which lists its
+// environments. it's read from disk or from any fs.FS, like an embed.FS or a
+// zip.Reader.
+type Tree struct {
+    Dir string
+    fsys fs.FS
+    config opts
+}
+
+// an Environment is a directory of a tree, or a file when the config lists
+// files, named like "prod/us-east" or, for the file prod.json, "prod"
+type Environment struct {
+    Name string
+    Path string
+}
+
+// Options are the options of a run
+type Options struct {
+    // NormalizedDir is the normalized tree, .carver in the config dir unless
+    // it's set
+    NormalizedDir string
+    // NormalizedFS is read for the normalized tree by Merge and Check when
+    // it's set, with NormalizedDir naming it in errors
+    NormalizedFS fs.FS
+    // Threshold overrides the threshold of the config: "all", "most", a
+    // percentage like "90%" or a fraction like "0.9"
+    Threshold string
+    // KeepGoing builds every file that doesn't depend on a file that can't be
+    // read, and returns them along with the errors
+    KeepGoing bool
+    // Jobs is the number of keymap groups loaded and built at once, one per
+    // CPU when it's 0
+    Jobs int
+    // Output receives the files of the run, the directory they belong in
+    // unless it's set
+    Output Sink
+}
+
+// Files are the files a run builds for a directory, which can be written
+// there or compared with the ones there
+type Files struct {
+    Dir string
+    sink Sink
+    filenames map[string]map[string]interface{}
+    layouts map[string]layout
+    copies map[string][]byte
+    // common holds the common files of a normalized tree, which the
+    // manifest lists apart
+    common map[string]bool
+    // complete is unset when some files couldn't be read, so nothing is
+    // pruned
+    complete bool
+}
+
+// Normalized are the files of a normalized tree
+type Normalized struct {
+    Files
+    // Suggested holds the layers found when the config asks for suggestions
+    // with "subsets: suggest", by name with their envs, or is nil
+    Suggested map[string][]string
+}
+
+// Merged are the files of the environments of a config tree
+type Merged struct {
+    Files
+}
+
+// LoadTree reads the .carver.yaml of a config directory
+func LoadTree(dir string) (Tree, error) {
+    dir = path.Clean(dir)
+    r := os_root(dir)
+    config, err := load_opts(r)
+    return Tree{dir, r.fsys, config}, err
+}
+
+// LoadTreeFS reads the .carver.yaml of a config directory within a file
+// system, where dir is a slash-separated path like "config", or "." for the
+// root of the file system
+func LoadTreeFS(fsys fs.FS, dir string) (Tree, error) {
+    dir = path.Clean(dir)
+    r, err := root{fsys, "."}.sub_root(dir)
+    if err != nil {
+        return Tree{Dir: dir}, err
+    }
+    config, err := load_opts(r)
+    return Tree{dir, r.fsys, config}, err
+}
+
+func (t Tree) root() root {
+    return root{t.fsys, t.Dir}
+}
+
+// Environments lists the environments of the tree, the leaves of its env
+// dirs or its env files
+func (t Tree) Environments() ([]Environment, error) {
+    envs := []Environment{}
+    g, err := new_group(t.config, t.root())
+    if err != nil {
+        return envs, err
+    }
+    fg, is_file_group := g.(*file_group)
+    for i, name := range g.get_envs() {
+        env := Environment{name, name}
+        if is_file_group {
+            env.Path = path.Clean(fg.files[i])
+        }
+        envs = append(envs, env)
+    }
+    return envs, nil
+}
+
+func (o Options) normalized_dir(t Tree) string {
+    if o.NormalizedDir == "" {
+        return path.Join(t.Dir, ".carver")
+    }
+    return path.Clean(o.NormalizedDir)
+}
+
+// normalized_root is the normalized tree to read, which is the .carver dir of
+// the tree's file system unless it's set
+func (o Options) normalized_root(t Tree) (root, error) {
+    switch {
+    case o.NormalizedFS != nil:
+        return root{o.NormalizedFS, o.normalized_dir(t)}, nil
+    case o.NormalizedDir != "":
+        return os_root(o.normalized_dir(t)), nil
+    }
+    return t.root().sub_root(".carver")
+}
+
+func (o Options) output(dir string) Sink {
+    if o.Output == nil {
+        return DiskSink(dir)
+    }
+    return o.Output
+}
+
+// Normalize builds the normalized tree of a config tree. files that can't be
+// read are errors, and with KeepGoing the files that don't depend on them are
+// still built.
+func Normalize(ctx context.Context, t Tree, o Options) (Normalized, error) {
+    n := Normalized{Files: Files{Dir: o.normalized_dir(t)}}
+    n.sink = o.output(n.Dir)
+    pol, err := get_policy(t.config, o.Threshold)
+    if err != nil {
+        return n, err
+    }
+    filenames, layouts, common, suggested, err := normalize_dir(ctx, t.config, pol, t.root(), o.KeepGoing, o.Jobs)
+    if ctx.Err() != nil {
+        return n, ctx.Err()
+    }
+    copies := map[string][]byte{}
+    if t.config.CopyUnmatched {
+        var copy_err error
+        copies, copy_err = copy_files(t.config, t.root())
+        err = error_list{}.add(err).add(copy_err).err()
+    }
+    if err != nil && !o.KeepGoing {
+        return n, err
+    }
+    n.Files = Files{n.Dir, n.sink, filenames, layouts, copies, common, err == nil}
+    if suggested != nil {
+        n.Suggested = map[string][]string{}
+        for _, s := range suggested {
+            n.Suggested[s.name] = s.leaves()
+        }
+    }
+    return n, err
+}
+
+// Merge rebuilds the environments of a config tree from its normalized tree.
+// errors are handled like in Normalize.
+func Merge(ctx context.Context, t Tree, o Options) (Merged, error) {
+    m := Merged{Files{Dir: t.Dir, sink: o.output(t.Dir)}}
+    n, err := o.normalized_root(t)
+    if err != nil {
+        return m, err
+    }
+    filenames, layouts, err := merge_dir(ctx, t.config, n, o.KeepGoing, o.Jobs)
+    if ctx.Err() != nil {
+        return m, ctx.Err()
+    }
+    copies := map[string][]byte{}
+    if t.config.CopyUnmatched {
+        var copy_err error
+        copies, copy_err = copy_files(t.config, n)
+        err = error_list{}.add(err).add(copy_err).err()
+    }
+    if err != nil && !o.KeepGoing {
+        return m, err
+    }
+    m.Files = Files{m.Dir, m.sink, filenames, layouts, copies, map[string]bool{}, err == nil}
+    return m, err
+}
+
+// Check describes every way the config tree and its normalized tree differ
+// from what Merge and Normalize would make of them, as lines like
+// "dev/app.json: /tls: expected true, got false"
+func Check(ctx context.Context, t Tree, o Options) ([]string, error) {
+    pol, err := get_policy(t.config, o.Threshold)
+    if err != nil {
+        return []string{}, err
+    }
+    n, err := o.normalized_root(t)
+    if err != nil {
+        return []string{}, err
+    }
+    return check(ctx, t.config, pol, t.root(), n, o.Jobs)
+}
+
+// Names lists the files by their path in Dir
+func (f Files) Names() []string {
+    names := []string{}
+    for name := range f.filenames {
+        names = append(names, name)
+    }
+    for name := range f.copies {
+        if _, ok := f.filenames[name]; !ok {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Render encodes the files as they would be written, by their path in Dir
+func (f Files) Render() (map[string][]byte, error) {
+    rendered, err := renderFiles(f.sink, f.Dir, f.filenames, f.layouts)
+    for name, b := range f.copies {
+        if _, ok := f.filenames[name]; !ok {
+            rendered[name] = b
+        }
+    }
+    return rendered, err
+}
+
+// Plan compares the files with the ones in their sink without writing
+// anything. the files carver wrote there before but no longer writes are
+// stale, or deleted when pruning.
+func (f Files) Plan(prune bool) (Report, error) {
+    return write_or_diff(f.sink, f.Dir, f.filenames, f.layouts, f.copies, f.common, true, prune, f.complete)
+}
+
+// Write commits the files that changed to their sink, all at once or not at
+// all, and with prune deletes the files carver wrote there before but no
+// longer writes
+func (f Files) Write(prune bool) (Report, error) {
+    return write_or_diff(f.sink, f.Dir, f.filenames, f.layouts, f.copies, f.common, false, prune, f.complete)
+}
@@ -0,0 +1,347 @@
+package carver
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "testing/fstest"
+)
+
+// copy_tree copies a test stack, leaving out its normalized tree
+func copy_tree(t * testing.T, root string) string {
+    dir := t.TempDir()
+    filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+        rel, _ := filepath.Rel(root, p)
+        if info.IsDir() && info.Name() == ".carver" {
+            return filepath.SkipDir
+        }
+        if info.IsDir() {
+            return os.MkdirAll(filepath.Join(dir, rel), 0750)
+        }
+        b, _ := os.ReadFile(p)
+        return os.WriteFile(filepath.Join(dir, rel), b, 0666)
+    })
+    return dir
+}
+
+func TestNormalizeMerge(t * testing.T) {
+    for _, root := range []string{"test_stack/test1", "test_stack/test4", "test_stack/test5"} {
+        dir := copy_tree(t, root)
+        tree, err := LoadTree(dir)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ctx := context.Background()
+        normalized, err := Normalize(ctx, tree, Options{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        _, err = normalized.Write(false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        rendered, _ := normalized.Render()
+        for name, b := range rendered {
+            expected, _ := os.ReadFile(filepath.Join(root, ".carver", name))
+            if string(b) != string(expected) {
+                t.Errorf(`%s: expected %q, got %q`, name, expected, b)
+            }
+        }
+        merged, err := Merge(ctx, tree, Options{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        report, err := merged.Plan(false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, c := range report {
+            // the first merge writes the manifest of the config dir
+            if c.Action != change_unchanged && c.name != manifest_name {
+                t.Errorf(`%s: expected merge to change nothing, got %s`, c.Path, c.Action)
+            }
+        }
+        problems, err := Check(ctx, tree, Options{})
+        if err != nil || len(problems) > 0 {
+            t.Errorf(`expected %s to check out, got %v`, root, problems)
+        }
+    }
+}
+
+// map_fs reads a test stack into memory under dir, leaving out its
+// normalized tree
+func map_fs(root string, dir string) fstest.MapFS {
+    fsys := fstest.MapFS{}
+    fs.WalkDir(os.DirFS(root), ".", func(p string, e fs.DirEntry, err error) error {
+        if e.IsDir() && e.Name() == ".carver" {
+            return fs.SkipDir
+        }
+        if !e.IsDir() {
+            b, _ := os.ReadFile(filepath.Join(root, p))
+            fsys[path.Join(dir, p)] = &fstest.MapFile{Data: b}
+        }
+        return nil
+    })
+    return fsys
+}
+
+func TestNormalizeMergeFS(t * testing.T) {
+    for _, root := range []string{"test_stack/test1", "test_stack/test5"} {
+        tree, err := LoadTreeFS(map_fs(root, "config"), "config")
+        if err != nil {
+            t.Fatal(err)
+        }
+        ctx := context.Background()
+        normalized_sink := NewMemorySink()
+        normalized, err := Normalize(ctx, tree, Options{Output: normalized_sink})
+        if err != nil {
+            t.Fatal(err)
+        }
+        _, err = normalized.Write(false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        normalized_fs := fstest.MapFS{}
+        for name, b := range normalized_sink.Files {
+            expected, _ := os.ReadFile(filepath.Join(root, ".carver", name))
+            if name != manifest_name && string(b) != string(expected) {
+                t.Errorf(`%s: expected %q, got %q`, name, expected, b)
+            }
+            normalized_fs[name] = &fstest.MapFile{Data: b}
+        }
+        // the config files keep their layouts, as they would on disk
+        config_sink := NewMemorySink()
+        for name, f := range map_fs(root, ".") {
+            config_sink.Files[name] = f.Data
+        }
+        o := Options{NormalizedDir: "normalized", NormalizedFS: normalized_fs, Output: config_sink}
+        merged, err := Merge(ctx, tree, o)
+        if err != nil {
+            t.Fatal(err)
+        }
+        report, err := merged.Plan(false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, c := range report {
+            // the first merge writes the manifest of the config dir
+            if c.Action != change_unchanged && c.name != manifest_name {
+                t.Errorf(`%s: expected merge to change nothing, got %s`, c.Path, c.Action)
+            }
+        }
+        problems, err := Check(ctx, tree, o)
+        if err != nil || len(problems) > 0 {
+            t.Errorf(`expected %s to check out, got %v (%v)`, root, problems, err)
+        }
+    }
+}
+
+// round_trip normalizes a tree in memory and merges it back, returning the
+// files merge would change, or the error that stopped it
+func round_trip(fsys fstest.MapFS) []string {
+    tree, err := LoadTreeFS(fsys, ".")
+    if err != nil {
+        return []string{err.Error()}
+    }
+    ctx := context.Background()
+    normalized_sink := NewMemorySink()
+    normalized, err := Normalize(ctx, tree, Options{Output: normalized_sink})
+    if err == nil {
+        _, err = normalized.Write(false)
+    }
+    if err != nil {
+        return []string{err.Error()}
+    }
+    normalized_fs := fstest.MapFS{}
+    for name, b := range normalized_sink.Files {
+        normalized_fs[name] = &fstest.MapFile{Data: b}
+    }
+    config_sink := NewMemorySink()
+    for name, f := range fsys {
+        config_sink.Files[name] = f.Data
+    }
+    o := Options{NormalizedDir: ".carver", NormalizedFS: normalized_fs, Output: config_sink}
+    merged, err := Merge(ctx, tree, o)
+    if err != nil {
+        return []string{err.Error()}
+    }
+    report, err := merged.Plan(false)
+    if err != nil {
+        return []string{err.Error()}
+    }
+    changed := []string{}
+    for _, c := range report {
+        if c.Action != change_unchanged && c.name != manifest_name {
+            changed = append(changed, c.Action + " " + c.Path)
+        }
+    }
+    return changed
+}
+
+func TestNumericKeysRoundTrip(t * testing.T) {
+    fsys := fstest.MapFS{
+        ".carver.yaml": {Data: []byte("dirs:\n - dev\n - prod\n")},
+        "dev/app.json": {Data: []byte("{\n  \"m\": {\n    \"0\": \"a\",\n    \"1\": \"b\"\n  },\n  \"l\": [\n    \"a\"\n  ]\n}\n")},
+        "prod/app.json": {Data: []byte("{\n  \"m\": {\n    \"0\": \"a\",\n    \"1\": \"c\"\n  },\n  \"l\": [\n    \"a\",\n    \"b\"\n  ]\n}\n")},
+    }
+    changed := round_trip(fsys)
+    if len(changed) > 0 {
+        t.Fatalf(`expected merge to change nothing, got %v`, changed)
+    }
+}
+
+// the normalized tree has no dir for an env without overrides
+func TestEnvWithoutOverridesRoundTrip(t * testing.T) {
+    testCases := map[string]testCaseOneArg[fstest.MapFS, []string]{
+        "identical": {fstest.MapFS{
+            ".carver.yaml": {Data: []byte("dirs:\n - dev\n - prod\n")},
+            "dev/app.json": {Data: []byte("{\"a\": 1}\n")},
+            "prod/app.json": {Data: []byte("{\"a\": 1}\n")},
+        }, []string{}},
+        "single": {fstest.MapFS{
+            ".carver.yaml": {Data: []byte("dirs:\n - dev\n")},
+            "dev/app.json": {Data: []byte("{\"a\": 1}\n")},
+        }, []string{}},
+        "one_like_common": {fstest.MapFS{
+            ".carver.yaml": {Data: []byte("dirs:\n - dev\n - stg\n - prod\n")},
+            "dev/app.json": {Data: []byte("{\"a\": 1}\n")},
+            "stg/app.json": {Data: []byte("{\"a\": 1, \"b\": 2}\n")},
+            "prod/app.json": {Data: []byte("{\"a\": 1, \"b\": 3}\n")},
+        }, []string{}},
+    }
+    runTestsOneArgParallel[fstest.MapFS, []string](t, round_trip, testCases)
+}
+
+// an env dropped from the config leaves its normalized dir behind when
+// normalize doesn't prune, which merge must not read as common files: once
+// normalize marks it stale it's left out, and before that it's an error
+func TestDroppedEnvNotMerged(t * testing.T) {
+    testCases := map[string]testCaseOneArg[bool, []string]{
+        "renormalized": {true, []string{"dev/x.json"}},
+        "not_renormalized": {false, []string{".carver/prod/x.json: not in a dir of the config, nor a common file of the manifest; normalize again to update it"}},
+    }
+    f := func(renormalize bool) []string {
+        ctx := context.Background()
+        fsys := fstest.MapFS{
+            "dev/x.json": {Data: []byte("{\"a\": 1}\n")},
+            "prod/x.json": {Data: []byte("{\"a\": 2}\n")},
+        }
+        configs := []string{"dirs:\n - dev\n - prod\n"}
+        if renormalize {
+            configs = append(configs, "dirs:\n - dev\n")
+        }
+        normalized_sink := NewMemorySink()
+        for _, config := range configs {
+            fsys[".carver.yaml"] = &fstest.MapFile{Data: []byte(config)}
+            tree, err := LoadTreeFS(fsys, ".")
+            if err != nil {
+                return []string{err.Error()}
+            }
+            normalized, err := Normalize(ctx, tree, Options{Output: normalized_sink})
+            if err == nil {
+                _, err = normalized.Write(false)
+            }
+            if err != nil {
+                return []string{err.Error()}
+            }
+        }
+        normalized_fs := fstest.MapFS{}
+        for name, b := range normalized_sink.Files {
+            normalized_fs[name] = &fstest.MapFile{Data: b}
+        }
+        fsys[".carver.yaml"] = &fstest.MapFile{Data: []byte("dirs:\n - dev\n")}
+        tree, _ := LoadTreeFS(fsys, ".")
+        o := Options{NormalizedDir: ".carver", NormalizedFS: normalized_fs, Output: NewMemorySink()}
+        merged, err := Merge(ctx, tree, o)
+        if err != nil {
+            return []string{err.Error()}
+        }
+        return merged.Names()
+    }
+    runTestsOneArgParallel[bool, []string](t, f, testCases)
+}
+
+// run with go test -race, the same trees are normalized on one worker and on
+// many, which must agree on the files and on the errors, and must not share a
+// keymap between workers
+func TestNormalizeJobs(t * testing.T) {
+    broken := fstest.MapFS{
+        ".carver.yaml": {Data: []byte("dirs:\n - a\n - b\n")},
+    }
+    for i := 0; i < 20; i++ {
+        broken[fmt.Sprintf("a/%02d.json", i)] = &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"x": %d, "y": 1}`, i))}
+        broken[fmt.Sprintf("b/%02d.json", i)] = &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"x": %d, "y": 2}`, i))}
+    }
+    broken["a/03.json"] = &fstest.MapFile{Data: []byte(`{"x": }`)}
+    broken["b/11.json"] = &fstest.MapFile{Data: []byte(`{"x": }`)}
+    trees := map[string]fs.FS{"broken": broken}
+    for _, root := range []string{"test_stack/test1", "test_stack/test3", "test_stack/test4", "test_stack/test5"} {
+        trees[root] = map_fs(root, ".")
+    }
+    type result struct {
+        Files map[string][]byte
+        Err string
+    }
+    run := func(fsys fs.FS, jobs int) result {
+        tree, err := LoadTreeFS(fsys, ".")
+        if err != nil {
+            return result{Err: err.Error()}
+        }
+        o := Options{KeepGoing: true, Jobs: jobs, Output: NewMemorySink()}
+        normalized, err := Normalize(context.Background(), tree, o)
+        files, _ := normalized.Render()
+        r := result{Files: files}
+        if err != nil {
+            r.Err = err.Error()
+        }
+        return r
+    }
+    for name, fsys := range trees {
+        expected := run(fsys, 1)
+        for _, jobs := range []int{2, 8, 0} {
+            got := run(fsys, jobs)
+            if !reflect.DeepEqual(got, expected) {
+                t.Errorf(`%s: expected %d jobs to match one, got %v and %v`, name, jobs, got.Err, expected.Err)
+            }
+        }
+        if name == "broken" && (len(expected.Files) != 54 || strings.Count(expected.Err, "\n") != 1) {
+            t.Errorf(`expected 54 files and two errors, got %d files and %q`, len(expected.Files), expected.Err)
+        }
+    }
+}
+
+func TestEnvironments(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, []Environment]{
+        "files": {
+            "test_stack/test1",
+            []Environment{{"dev", "dev.json"}, {"staging", "staging.json"}, {"prod", "prod.json"}, {"test", "test.yaml"}},
+        },
+        "dirs": {
+            "test_stack/test5",
+            []Environment{{"dev", "dev"}, {"prod/us", "prod/us"}, {"prod/eu", "prod/eu"}},
+        },
+    }
+    f := func(root string) []Environment {
+        tree, _ := LoadTree(root)
+        envs, _ := tree.Environments()
+        return envs
+    }
+    runTestsOneArgParallel[string, []Environment](t, f, testCases)
+}
+
+func TestNormalizeCanceled(t * testing.T) {
+    tree, _ := LoadTree("test_stack/test5")
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    normalized, err := Normalize(ctx, tree, Options{})
+    if !errors.Is(err, context.Canceled) || len(normalized.Names()) != 0 {
+        t.Fatalf(`expected a canceled run to build nothing, got %v and %v`, normalized.Names(), err)
+    }
+}
@@ -0,0 +1,50 @@
+package carver
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "bytes"
+    "io"
+    "io/fs"
+    "path"
+)
+
+// TarFS reads a tar archive into memory as a file system, so that a config
+// bundle can be loaded with LoadTreeFS without unpacking it. a zip archive is
+// already one, as a *zip.Reader.
+func TarFS(r io.Reader) (fs.FS, error) {
+    // the files are repacked as a zip, whose reader serves them along with
+    // the directories they imply
+    var buf bytes.Buffer
+    zw := zip.NewWriter(&buf)
+    tr := tar.NewReader(r)
+    for {
+        h, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if h.Typeflag != tar.TypeReg {
+            continue
+        }
+        // archives made with tar -C dir . name their files ./a.json
+        name := path.Clean(h.Name)
+        if !fs.ValidPath(name) {
+            return nil, &fs.PathError{Op: "open", Path: h.Name, Err: fs.ErrInvalid}
+        }
+        w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: h.ModTime})
+        if err == nil {
+            _, err = io.Copy(w, tr)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    err := zw.Close()
+    if err != nil {
+        return nil, err
+    }
+    return zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+}
@@ -0,0 +1,31 @@
+package carver
+
+import (
+    "archive/tar"
+    "bytes"
+    "testing"
+)
+
+func TestTarFS(t * testing.T) {
+    testCases := map[string]testCaseOneArg[[]string, map[string]string]{
+        "plain": {[]string{"a.json", "b/c.json"}, map[string]string{"a.json": "a.json", "b/c.json": "b/c.json"}},
+        "dot": {[]string{"./a.json", "./b/c.json"}, map[string]string{"a.json": "./a.json", "b/c.json": "./b/c.json"}},
+        "outside": {[]string{"../a.json"}, nil},
+    }
+    f := func(names []string) map[string]string {
+        var buf bytes.Buffer
+        tw := tar.NewWriter(&buf)
+        tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755})
+        for _, name := range names {
+            tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(name))})
+            tw.Write([]byte(name))
+        }
+        tw.Close()
+        fsys, err := TarFS(&buf)
+        if err != nil {
+            return nil
+        }
+        return fs_contents(fsys)
+    }
+    runTestsOneArgParallel[[]string, map[string]string](t, f, testCases)
+}
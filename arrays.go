@@ -0,0 +1,376 @@
+package carver
+
+import (
+    "fmt"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+// an array_strategy says how the arrays at a path are split into keys:
+//
+//   atomic  the whole array is one value
+//   index   each item is keyed by its index, e.g. /list/0
+//   set     each item is keyed by its value, so a file adds items to the ones
+//           it inherits
+//   keyed   each item is an object keyed by an identity field, e.g.
+//           /containers/web for the container named web
+type array_strategy struct {
+    kind string
+    key string
+}
+
+// array_strategies maps paths to strategies. a * in a path matches any one
+// key, e.g. /containers/*/ports. arrays at other paths use index.
+type array_strategies map[string]array_strategy
+
+// new_array_strategies parses the "arrays" config, e.g. "keyed" or
+// "keyed:id". keyed items are matched by name unless a field is given. paths
+// are json pointers, or dotted paths like containers.*.ports when none of
+// their keys contain a dot.
+func new_array_strategies(config map[string]string) (array_strategies, error) {
+    arrays := array_strategies{}
+    for p, s := range config {
+        if !strings.HasPrefix(p, "/") {
+            dotted := p
+            p = ""
+            for _, key := range strings.Split(dotted, ".") {
+                p = join_path(p, key)
+            }
+        }
+        kind, key, _ := strings.Cut(strings.TrimSpace(s), ":")
+        switch kind {
+        case "atomic", "index", "set":
+            if key != "" {
+                return arrays, fmt.Errorf("array strategy %s of %s takes no field", kind, p)
+            }
+        case "keyed":
+            if key == "" {
+                key = "name"
+            }
+        default:
+            return arrays, fmt.Errorf("unknown array strategy %q for %s", s, p)
+        }
+        arrays[p] = array_strategy{kind, key}
+    }
+    return arrays, nil
+}
+
+func (arrays array_strategies) get(p string) array_strategy {
+    s, ok := arrays[p]
+    if ok {
+        return s
+    }
+    patterns := []string{}
+    for pattern := range arrays {
+        patterns = append(patterns, pattern)
+    }
+    sort.Strings(patterns)
+    for _, pattern := range patterns {
+        if match_path(pattern, p) {
+            return arrays[pattern]
+        }
+    }
+    return array_strategy{"index", ""}
+}
+
+func match_path(pattern string, p string) bool {
+    pattern_parts := split_path(pattern)
+    parts := split_path(p)
+    if len(pattern_parts) != len(parts) {
+        return false
+    }
+    for i := range parts {
+        ok, _ := path.Match(pattern_parts[i], parts[i])
+        if !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// set_key is the key of a set item: strings are their own key and other
+// values are keyed by their json. items that share a key, like "1" and 1, are
+// an error in flatten.
+func set_key(item interface{}) string {
+    s, ok := item.(string)
+    if ok {
+        return s
+    }
+    b, _ := json.Marshal(item)
+    return string(b)
+}
+
+// set_tombstone is how a set item that a file removes is written, e.g.
+// {"$delete": "a"}
+func set_tombstone(item interface{}) (interface{}, bool) {
+    obj, ok := item.(map[string]interface{})
+    if !ok || len(obj) != 1 {
+        return nil, false
+    }
+    v, ok := obj[tombstone]
+    return v, ok
+}
+
+// flatten turns an object into a flat object keyed by json pointers, splitting
+// arrays by their strategies. empty objects and arrays are kept as values.
+func flatten(obj map[string]interface{}, arrays array_strategies) (map[string]interface{}, error) {
+    flat := map[string]interface{}{}
+    var walk func(prefix string, v interface{}) error
+    walk = func(prefix string, v interface{}) error {
+        switch vv := v.(type) {
+        case map[string]interface{}:
+            if len(vv) == 0 {
+                flat[prefix] = vv
+            }
+            for k, c := range vv {
+                err := walk(join_path(prefix, k), c)
+                if err != nil {
+                    return err
+                }
+            }
+        case []interface{}:
+            s := arrays.get(prefix)
+            if len(vv) == 0 || s.kind == "atomic" {
+                flat[prefix] = vv
+                return nil
+            }
+            // the set items by key, to catch items that share one
+            items := map[string]interface{}{}
+            for i, c := range vv {
+                switch s.kind {
+                case "set":
+                    removed, is_tombstone := set_tombstone(c)
+                    item := c
+                    if is_tombstone {
+                        item = removed
+                    }
+                    key := set_key(item)
+                    if other, dup := items[key]; dup && json_scalar(other) != json_scalar(item) {
+                        return fmt.Errorf("%s: items %s and %s have the same key %s", prefix, json_scalar(other), json_scalar(item), key)
+                    }
+                    items[key] = item
+                    if is_tombstone {
+                        flat[join_path(prefix, key)] = tombstone
+                        continue
+                    }
+                    flat[join_path(prefix, key)] = c
+                case "keyed":
+                    id, err := item_id(c, s.key)
+                    if err != nil {
+                        return fmt.Errorf("%s/%d: %s", prefix, i, err)
+                    }
+                    _, dup := flat[join_path(join_path(prefix, id), s.key)]
+                    if dup {
+                        return fmt.Errorf("%s: more than one item with %s %s", prefix, s.key, id)
+                    }
+                    err = walk(join_path(prefix, id), c)
+                    if err != nil {
+                        return err
+                    }
+                default:
+                    err := walk(join_path(prefix, strconv.Itoa(i)), c)
+                    if err != nil {
+                        return err
+                    }
+                }
+            }
+        default:
+            flat[prefix] = vv
+        }
+        return nil
+    }
+    err := walk("", obj)
+    return flat, err
+}
+
+func item_id(item interface{}, key string) (string, error) {
+    obj, ok := item.(map[string]interface{})
+    if !ok {
+        return "", fmt.Errorf("keyed array item is not an object")
+    }
+    id, ok := obj[key]
+    if !ok {
+        return "", fmt.Errorf("keyed array item has no %s", key)
+    }
+    return fmt.Sprint(id), nil
+}
+
+// rename_paths maps the index paths of every key in obj, as a file layout
+// records them, to the paths flatten gives them. keys inside an atomic array
+// are left out, since the array is a single value.
+func rename_paths(obj map[string]interface{}, arrays array_strategies) map[string]string {
+    renames := map[string]string{}
+    var walk func(old_p string, new_p string, v interface{})
+    walk = func(old_p string, new_p string, v interface{}) {
+        renames[old_p] = new_p
+        switch vv := v.(type) {
+        case map[string]interface{}:
+            for k, c := range vv {
+                walk(join_path(old_p, k), join_path(new_p, k), c)
+            }
+        case []interface{}:
+            s := arrays.get(new_p)
+            for i, c := range vv {
+                old_c := join_path(old_p, strconv.Itoa(i))
+                switch s.kind {
+                case "atomic":
+                case "set":
+                    removed, ok := set_tombstone(c)
+                    if ok {
+                        c = removed
+                    }
+                    renames[old_c] = join_path(new_p, set_key(c))
+                case "keyed":
+                    id, err := item_id(c, s.key)
+                    if err == nil {
+                        walk(old_c, join_path(new_p, id), c)
+                    }
+                default:
+                    walk(old_c, join_path(new_p, strconv.Itoa(i)), c)
+                }
+            }
+        }
+    }
+    walk("", "", obj)
+    return renames
+}
+
+// index_arrays lists the paths flatten gives the arrays of obj that it splits
+// by index, which are the only objects keyed 0 to n-1 that are written back as
+// arrays
+func index_arrays(obj map[string]interface{}, arrays array_strategies) map[string]bool {
+    found := map[string]bool{}
+    var walk func(p string, v interface{})
+    walk = func(p string, v interface{}) {
+        switch vv := v.(type) {
+        case map[string]interface{}:
+            for k, c := range vv {
+                walk(join_path(p, k), c)
+            }
+        case []interface{}:
+            s := arrays.get(p)
+            for i, c := range vv {
+                switch s.kind {
+                case "atomic", "set":
+                case "keyed":
+                    id, err := item_id(c, s.key)
+                    if err == nil {
+                        walk(join_path(p, id), c)
+                    }
+                default:
+                    found[p] = true
+                    walk(join_path(p, strconv.Itoa(i)), c)
+                }
+            }
+        }
+    }
+    walk("", obj)
+    return found
+}
+
+// rekey moves a layout read from a file onto the paths flatten gives the keys
+// of its object obj, and records which of them were index arrays
+func (l layout) rekey(obj map[string]interface{}, arrays array_strategies) layout {
+    l.arrays = arrays
+    l.index_arrays = index_arrays(obj, arrays)
+    if len(arrays) == 0 {
+        return l
+    }
+    renames := rename_paths(obj, arrays)
+    order := []string{}
+    seen := map[string]bool{}
+    for _, p := range l.order {
+        // keys inside atomic arrays and set items take the path of the value
+        // that holds them
+        for _, ok := renames[p]; !ok && p != ""; _, ok = renames[p] {
+            p = parent_path(p)
+        }
+        p = renames[p]
+        if !seen[p] {
+            order = append(order, p)
+            seen[p] = true
+        }
+    }
+    l.order = order
+    inline := map[string]bool{}
+    for p, v := range l.inline {
+        if new_p, ok := renames[p]; ok {
+            inline[new_p] = v
+        }
+    }
+    l.inline = inline
+    comments := map[string]comment{}
+    for p, c := range l.comments {
+        if new_p, ok := renames[p]; ok {
+            comments[new_p] = c
+        }
+    }
+    l.comments = comments
+    tight_headers := map[string]bool{}
+    for p, v := range l.tight_headers {
+        if new_p, ok := renames[p]; ok {
+            tight_headers[new_p] = v
+        }
+    }
+    l.tight_headers = tight_headers
+    styles := map[string]style{}
+    for p, st := range l.styles {
+        if new_p, ok := renames[p]; ok {
+            styles[new_p] = st
+        }
+    }
+    l.styles = styles
+    anchors := map[string]anchor{}
+    for p, a := range l.anchors {
+        if new_p, ok := renames[p]; ok {
+            anchors[new_p] = a
+        }
+    }
+    l.anchors = anchors
+    return l
+}
+
+// add_identities gives every keyed array item in the files of a group its
+// identity field, so an override file that only changes one field of an item
+// still says which item it changes. the value comes from the file that sets
+// it, or from the key of the item.
+func add_identities(filenames map[string]map[string]interface{}, arrays array_strategies) {
+    if len(arrays) == 0 {
+        return
+    }
+    identities := map[string]interface{}{}
+    for _, obj := range filenames {
+        for k, v := range obj {
+            identities[k] = v
+        }
+    }
+    for _, obj := range filenames {
+        keys := []string{}
+        for k := range obj {
+            keys = append(keys, k)
+        }
+        for _, k := range keys {
+            parts := split_path(k)
+            prefix := ""
+            for i := 0; i < len(parts) - 2; i++ {
+                prefix = join_path(prefix, parts[i])
+                s := arrays.get(prefix)
+                if s.kind != "keyed" {
+                    continue
+                }
+                id_path := join_path(join_path(prefix, parts[i+1]), s.key)
+                if _, ok := obj[id_path]; ok {
+                    continue
+                }
+                id, ok := identities[id_path]
+                if !ok || id == tombstone {
+                    id = parts[i+1]
+                }
+                obj[id_path] = id
+            }
+        }
+    }
+}
@@ -0,0 +1,132 @@
+package carver
+
+import (
+    "testing"
+    "encoding/json"
+)
+
+var test_arrays = array_strategies{
+    "/args": {"set", ""},
+    "/containers": {"keyed", "name"},
+    "/containers/*/ports": {"atomic", ""},
+}
+
+func TestFlatten(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, map[string]interface{}]{
+        "index": {
+            `{"list": ["a", {"b": 1}], "empty": []}`,
+            map[string]interface{}{
+                "/list/0": "a",
+                "/list/1/b": json.Number("1"),
+                "/empty": []interface{}{},
+            },
+        },
+        "escaped_keys": {
+            `{"log.level": "info", "a/b": {"~c": 1, "example.com": true}}`,
+            map[string]interface{}{
+                "/log.level": "info",
+                "/a~1b/~0c": json.Number("1"),
+                "/a~1b/example.com": true,
+            },
+        },
+        "set": {
+            `{"args": ["--verbose", 2, {"$delete": "--debug"}, "--verbose"]}`,
+            map[string]interface{}{
+                "/args/--verbose": "--verbose",
+                "/args/2": json.Number("2"),
+                "/args/--debug": tombstone,
+            },
+        },
+        "keyed_atomic": {
+            `{"containers": [{"name": "web", "image": "web:1", "ports": [80, 443]}]}`,
+            map[string]interface{}{
+                "/containers/web/name": "web",
+                "/containers/web/image": "web:1",
+                "/containers/web/ports": []interface{}{json.Number("80"), json.Number("443")},
+            },
+        },
+    }
+    f := func(in string) map[string]interface{} {
+        flat, _ := flatten(decode_test_object(in), test_arrays)
+        return flat
+    }
+    runTestsOneArgParallel[string, map[string]interface{}](t, f, testCases)
+}
+
+func TestFlattenErrors(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "no_name": {
+            `{"containers": [{"image": "web:1"}]}`,
+            "/containers/0: keyed array item has no name",
+        },
+        "duplicate": {
+            `{"containers": [{"name": "web"}, {"name": "web"}]}`,
+            "/containers: more than one item with name web",
+        },
+        "set_collision": {
+            `{"args": ["1", 1, true]}`,
+            `/args: items "1" and 1 have the same key 1`,
+        },
+        "set_tombstone_collision": {
+            `{"args": ["true", {"$delete": true}]}`,
+            `/args: items "true" and true have the same key true`,
+        },
+    }
+    f := func(in string) string {
+        _, err := flatten(decode_test_object(in), test_arrays)
+        return err.Error()
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestEncodeArrays(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, map[string]interface{}, string]{
+        "keeps_item_order": {
+            "args:\n  - b\n  - a\ncontainers:\n  # proxy first\n  - name: proxy\n    ports: [1, 2]\n  - name: app\n",
+            map[string]interface{}{
+                "/args/a": "a",
+                "/args/b": "b",
+                "/args/c": "c",
+                "/containers/app/name": "app",
+                "/containers/proxy/name": "proxy",
+                "/containers/proxy/ports": []interface{}{1, 2},
+            },
+            "args:\n  - b\n  - a\n  - c\ncontainers:\n  # proxy first\n  - name: proxy\n    ports: [1, 2]\n  - name: app\n",
+        },
+        "set_tombstone": {
+            "args:\n  - a\n",
+            map[string]interface{}{
+                "/args/a": tombstone,
+            },
+            "args:\n  - $delete: a\n",
+        },
+    }
+    f := func(template string, obj map[string]interface{}) string {
+        existing, _ := yaml_codec{}.decode([]byte(template))
+        l := yaml_codec{}.read_layout([]byte(template)).rekey(existing, test_arrays)
+        b, _ := encode_file(obj, l, yaml_codec{})
+        return string(b)
+    }
+    runTestsTwoArgsParallel[string, map[string]interface{}, string](t, f, testCases)
+}
+
+func TestAddIdentities(t * testing.T) {
+    filenames := map[string]map[string]interface{}{
+        "app.json": {
+            "/containers/web/name": "web",
+            "/containers/web/ports": []interface{}{80},
+        },
+        "dev/app.json": {
+            "/containers/web/image": "web:dev",
+        },
+    }
+    add_identities(filenames, test_arrays)
+    if filenames["dev/app.json"]["/containers/web/name"] != "web" {
+        t.Errorf("expected the dev item to be named web, got %v", filenames["dev/app.json"])
+    }
+}
+
+func decode_test_object(in string) map[string]interface{} {
+    obj, _ := yaml_codec{}.decode([]byte(in))
+    return obj
+}
@@ -1,8 +1,13 @@
-package main
+package carver
 
 import (
+    "fmt"
+    "path"
+    "sort"
+    "bytes"
+    "reflect"
+    "strings"
     "encoding/json"
-    "github.com/nqd/flat"
 )
 
 
@@ -22,15 +27,466 @@ type monad struct {
 type keymap_group struct {
     id string
     km monad
+    layouts map[string]layout
 }
 
+// a layer is a file that gets stacked on top of its ancestors. the root layer
+// is the common file and the leaves are the env files. a layer with an empty
+// name only groups its children and never holds values.
+type layer struct {
+    name string
+    children []layer
+}
+
+// a km_value identifies one value of a keymap path
+type km_value struct {
+    t string
+    v string
+}
+
+// a tombstone in an override file deletes a key that the layers above it set
+const tombstone = "$delete"
+
+var tombstone_value = km_value{"string", `"` + tombstone + `"`}
+
+// a policy decides when normalize may promote a value that not every leaf
+// below a layer has
+type policy struct {
+    // promote values that most leaves have and give the rest a tombstone
+    tombstones bool
+    // promote the most common value when at least this fraction of the leaves
+    // have it. the other leaves keep their own values as overrides.
+    threshold float64
+    // promote the most common value whenever that saves entries
+    most bool
+}
+
+func new_layer(common_name string, names []string) layer {
+    l := layer{common_name, []layer{}}
+    for _, name := range names {
+        if name == common_name {
+            continue
+        }
+        l.children = append(l.children, layer{name, []layer{}})
+    }
+    return l
+}
+
+// new_layer_tree builds a layer tree from slash separated names. e.g.
+// "prod/us-east/canary" becomes a leaf under "prod/us-east" under "prod".
+func new_layer_tree(root_name string, names []string) (layer, error) {
+    l := layer{root_name, []layer{}}
+    for _, name := range names {
+        name = path.Clean(name)
+        l = l.insert(strings.Split(name, "/"), "")
+    }
+    for _, name := range names {
+        name = path.Clean(name)
+        for _, internal_name := range l.internal_names() {
+            if internal_name == name {
+                return l, fmt.Errorf("env %s contains other envs", name)
+            }
+        }
+    }
+    return l, nil
+}
+
+func (l layer) insert(parts []string, prefix string) layer {
+    name := path.Join(prefix, parts[0])
+    i := 0
+    for ; i < len(l.children); i++ {
+        if l.children[i].name == name {
+            break
+        }
+    }
+    if i == len(l.children) {
+        l.children = append(l.children, layer{name, []layer{}})
+    }
+    if len(parts) > 1 {
+        l.children[i] = l.children[i].insert(parts[1:], name)
+    }
+    return l
+}
+
+func (l layer) rename(f func(string) string) layer {
+    renamed := layer{f(l.name), []layer{}}
+    for _, c := range l.children {
+        renamed.children = append(renamed.children, c.rename(f))
+    }
+    return renamed
+}
+
+func (l layer) leaves() []string {
+    if len(l.children) == 0 {
+        return []string{l.name}
+    }
+    names := []string{}
+    for _, c := range l.children {
+        names = append(names, c.leaves()...)
+    }
+    return names
+}
+
+// internal_names lists every layer below the root that isn't a leaf
+func (l layer) internal_names() []string {
+    names := []string{}
+    for _, c := range l.children {
+        if len(c.children) == 0 {
+            continue
+        }
+        names = append(names, c.name)
+        names = append(names, c.internal_names()...)
+    }
+    return names
+}
+
+// stacks maps each leaf to the layers that produce it, from the root down to
+// the leaf itself
+func (l layer) stacks() map[string][]string {
+    stacks := map[string][]string{}
+    l.add_stacks([]string{}, stacks)
+    return stacks
+}
+
+func (l layer) add_stacks(stack []string, stacks map[string][]string) {
+    if l.name != "" {
+        stack = append(stack[:len(stack):len(stack)], l.name)
+    }
+    if len(l.children) == 0 {
+        stacks[l.name] = stack
+        return
+    }
+    for _, c := range l.children {
+        c.add_stacks(stack, stacks)
+    }
+}
+
+// prune drops the leaves that aren't in names. a layer that lost some of its
+// leaves can't hold values anymore, since they would leak into the leaves
+// that are missing, so it loses its name.
+func (l layer) prune(names []string) layer {
+    present := map[string]bool{}
+    for _, name := range names {
+        present[name] = true
+    }
+    return l.prune_set(present)
+}
+
+func (l layer) prune_set(present map[string]bool) layer {
+    if len(l.children) == 0 {
+        return l
+    }
+    pruned := layer{l.name, []layer{}}
+    for _, c := range l.children {
+        c_pruned := c.prune_set(present)
+        if len(c.children) == 0 && !present[c.name] {
+            pruned.name = ""
+            continue
+        }
+        if len(c.children) > 0 && len(c_pruned.children) == 0 {
+            pruned.name = ""
+            continue
+        }
+        if c_pruned.name == "" {
+            pruned.name = ""
+        }
+        pruned.children = append(pruned.children, c_pruned)
+    }
+    return pruned
+}
+
+// reachable lists the leaves which have at least one layer in names
+func (l layer) reachable(names []string) []string {
+    present := map[string]bool{}
+    for _, name := range names {
+        present[name] = true
+    }
+    leaves := []string{}
+    stacks := l.stacks()
+    for _, leaf := range l.leaves() {
+        for _, name := range stacks[leaf] {
+            if present[name] {
+                leaves = append(leaves, leaf)
+                break
+            }
+        }
+    }
+    return leaves
+}
+
+// shared_value returns the value that every leaf has in common, if any
+func (l layer) shared_value(values map[string]km_value) (km_value, bool) {
+    var shared km_value
+    for i, leaf := range l.leaves() {
+        v, ok := values[leaf]
+        if !ok || (i > 0 && v != shared) {
+            return km_value{}, false
+        }
+        shared = v
+    }
+    return shared, true
+}
+
+// promoted_value returns the value this layer should hold under the policy,
+// if any. a value that some leaves lack can only be promoted with tombstones,
+// and without a threshold it's promoted when the tombstones take fewer entries
+// than the copies they replace.
+func (l layer) promoted_value(values map[string]km_value, pol policy) (km_value, bool) {
+    shared, ok := l.shared_value(values)
+    if ok || !(pol.tombstones || pol.most || pol.threshold > 0) {
+        return shared, ok
+    }
+    counts := map[km_value]int{}
+    missing := 0
+    leaves := l.leaves()
+    for _, leaf := range leaves {
+        v, ok := values[leaf]
+        if !ok {
+            missing++
+            continue
+        }
+        counts[v]++
+    }
+    count := 0
+    for v, c := range counts {
+        if c > count || (c == count && (v.t < shared.t || (v.t == shared.t && v.v < shared.v))) {
+            shared = v
+            count = c
+        }
+    }
+    if missing > 0 && !pol.tombstones {
+        return km_value{}, false
+    }
+    switch {
+    case pol.threshold > 0:
+        return shared, float64(count) >= pol.threshold * float64(len(leaves))
+    case pol.most:
+        return shared, 1 + missing < count
+    default:
+        return shared, len(counts) == 1 && 1 + missing < count
+    }
+}
+
+// assign places each value in the highest layer the policy allows, unless an
+// ancestor already provides it. leaves that lack an inherited value get a
+// tombstone.
+func (l layer) assign(values map[string]km_value, inherited km_value, assigned map[string]km_value, pol policy) {
+    if len(l.children) == 0 {
+        v, ok := values[l.name]
+        if ok && v != inherited {
+            assigned[l.name] = v
+        }
+        if !ok && inherited != (km_value{}) {
+            assigned[l.name] = tombstone_value
+        }
+        return
+    }
+    if l.name != "" {
+        v, ok := l.promoted_value(values, pol)
+        if ok && v != inherited {
+            assigned[l.name] = v
+            inherited = v
+        }
+    }
+    for _, c := range l.children {
+        c.assign(values, inherited, assigned, pol)
+    }
+}
+
+// a subset is a layer that cuts across the tree. its children are the leaves
+// it applies to, and it sits between their tree layers and the leaves
+// themselves. e.g. a "non-prod" subset of "dev" and "staging".
+func new_subset(name string, leaves []string) layer {
+    return new_layer(name, leaves)
+}
+
+// prune_subsets keeps the subsets whose leaves are all in names
+func prune_subsets(subsets []layer, names []string) []layer {
+    present := map[string]bool{}
+    for _, name := range names {
+        present[name] = true
+    }
+    pruned := []layer{}
+    for _, s := range subsets {
+        complete := true
+        for _, leaf := range s.leaves() {
+            complete = complete && present[leaf]
+        }
+        if complete {
+            pruned = append(pruned, s)
+        }
+    }
+    return pruned
+}
+
+// stack_subsets puts each subset into the stacks of its leaves, right below
+// the leaf
+func stack_subsets(stacks map[string][]string, subsets []layer) map[string][]string {
+    for _, s := range subsets {
+        for _, leaf := range s.leaves() {
+            stack, ok := stacks[leaf]
+            if !ok {
+                continue
+            }
+            top := len(stack) - 1
+            stack = append(stack[:top:top], s.name, stack[top])
+            stacks[leaf] = stack
+        }
+    }
+    return stacks
+}
+
+// hoist moves a value out of the leaves into a subset when every leaf of the
+// subset would otherwise carry it
+func hoist(assigned map[string]km_value, subsets []layer) {
+    for _, s := range subsets {
+        leaves := s.leaves()
+        v, shared := assigned[leaves[0]]
+        for _, leaf := range leaves {
+            w, ok := assigned[leaf]
+            shared = shared && ok && w == v
+        }
+        if !shared {
+            continue
+        }
+        assigned[s.name] = v
+        for _, leaf := range leaves {
+            delete(assigned, leaf)
+        }
+    }
+}
+
+// leaf_sets lists the leaves that share each value normalize leaves in more
+// than one leaf. each set is sorted.
+func (km keymap) leaf_sets(l layer, subsets []layer, pol policy) [][]string {
+    sets := [][]string{}
+    leaves := map[string]bool{}
+    for _, leaf := range l.leaves() {
+        leaves[leaf] = true
+    }
+    for p := range km {
+        assigned := map[string]km_value{}
+        l.assign(km.values(p), km_value{}, assigned, pol)
+        hoist(assigned, subsets)
+        by_value := map[km_value][]string{}
+        for name, v := range assigned {
+            if leaves[name] {
+                by_value[v] = append(by_value[v], name)
+            }
+        }
+        for _, set := range by_value {
+            if len(set) > 1 {
+                sort.Strings(set)
+                sets = append(sets, set)
+            }
+        }
+    }
+    return sets
+}
+
+func contains_all(set []string, subset []string) bool {
+    members := map[string]bool{}
+    for _, name := range set {
+        members[name] = true
+    }
+    for _, name := range subset {
+        if !members[name] {
+            return false
+        }
+    }
+    return true
+}
+
+func remove_all(set []string, subset []string) []string {
+    removed := []string{}
+    for _, name := range set {
+        if !contains_all(subset, []string{name}) {
+            removed = append(removed, name)
+        }
+    }
+    return removed
+}
+
+// choose_subsets greedily picks the leaf sets that save the most override
+// entries when they become a layer of their own. a set is only picked if it
+// saves at least min_savings entries.
+func choose_subsets(sets [][]string, min_savings int) [][]string {
+    chosen := [][]string{}
+    for {
+        best := []string{}
+        best_key := ""
+        best_savings := 0
+        seen := map[string]bool{}
+        for _, candidate := range sets {
+            key := strings.Join(candidate, "\x00")
+            if len(candidate) < 2 || seen[key] {
+                continue
+            }
+            seen[key] = true
+            savings := 0
+            for _, set := range sets {
+                if contains_all(set, candidate) {
+                    savings += len(candidate) - 1
+                }
+            }
+            if savings > best_savings || (savings == best_savings && key < best_key) {
+                best = candidate
+                best_key = key
+                best_savings = savings
+            }
+        }
+        if best_savings < min_savings {
+            return chosen
+        }
+        chosen = append(chosen, best)
+        for i, set := range sets {
+            if contains_all(set, best) {
+                sets[i] = remove_all(set, best)
+            }
+        }
+    }
+}
+
+// type_to_string tags a value with its json type. numbers written without a
+// fraction or exponent are ints. objects and arrays only reach the keymap
+// when they are empty or atomic.
 func type_to_string(v interface{}) string {
-    switch v.(type) {
+    switch vv := v.(type) {
+    case nil:
+        return "null"
     case bool:
         return "bool"
-    default:
+    case datetime:
+        return "datetime"
+    case string:
         return "string"
+    case json.Number:
+        if strings.ContainsAny(vv.String(), ".eE") {
+            return "number"
+        }
+        return "int"
+    case float32, float64:
+        return "number"
+    case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+        return "int"
+    }
+    switch reflect.ValueOf(v).Kind() {
+    case reflect.Map, reflect.Struct:
+        return "object"
+    case reflect.Slice, reflect.Array:
+        return "array"
     }
+    return "string"
+}
+
+// decode_value decodes json keeping numbers as json.Number, so they are
+// written back exactly as they were read
+func decode_value(b []byte) (interface{}, error) {
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    var v interface{}
+    err := dec.Decode(&v)
+    return v, err
 }
 
 func (m monad) get_names() []string {
@@ -64,6 +520,60 @@ func (km keymap) set_node(p string, v interface{}, kmn keymap_node) keymap {
     return km
 }
 
+// values returns the value of path p in each file
+func (km keymap) values(p string) map[string]km_value {
+    values := map[string]km_value{}
+    for t := range km[p] {
+        for vStr, kmn := range km[p][t] {
+            for n := range kmn.Paths {
+                values[n] = km_value{t, vStr}
+            }
+        }
+    }
+    return values
+}
+
+// set_values moves the files of path p to the given values. nodes that end up
+// with no files are removed, and values that have no node yet get one.
+func (km keymap) set_values(p string, values map[string]km_value) keymap {
+    for _, v := range values {
+        _, ok := km[p][v.t][v.v]
+        if ok {
+            continue
+        }
+        if km[p] == nil {
+            km[p] = map[string]map[string]keymap_node{}
+        }
+        if km[p][v.t] == nil {
+            km[p][v.t] = map[string]keymap_node{}
+        }
+        km[p][v.t][v.v] = keymap_node{Count: 0, Paths: map[string]interface{}{}}
+    }
+    for t := range km[p] {
+        for vStr := range km[p][t] {
+            kmn := km[p][t][vStr]
+            kmn.Paths = map[string]interface{}{}
+            for n, v := range values {
+                if v == (km_value{t, vStr}) {
+                    kmn.Paths[n] = map[string]interface{}{}
+                }
+            }
+            if len(kmn.Paths) == 0 {
+                delete(km[p][t], vStr)
+                continue
+            }
+            if kmn.Count == 0 {
+                kmn.Count = len(kmn.Paths)
+            }
+            km[p][t][vStr] = kmn
+        }
+        if len(km[p][t]) == 0 {
+            delete(km[p], t)
+        }
+    }
+    return km
+}
+
 func (m monad) bind(f func(keymap, ...interface{}) (keymap, error), args ...interface{}) monad {
     if m.err != nil {
         return monad{m.err, m.km, m.names}
@@ -78,8 +588,10 @@ func (km keymap) to_files() map[string]map[string]interface{} {
         for t := range km[p] {
             for vStr := range km[p][t] {
                 kmn := km[p][t][vStr]
-                var v interface{}
-                json.Unmarshal([]byte(vStr), &v)
+                v, _ := decode_value([]byte(vStr))
+                if t == "datetime" {
+                    v = datetime(v.(string))
+                }
                 for n := range kmn.Paths {
                     _, exists := filenames[n]
                     if !exists {
@@ -96,9 +608,26 @@ func (km keymap) to_files() map[string]map[string]interface{} {
     return filenames
 }
 
+// km_merge adds a file to a keymap. when the file is a source file, the
+// second argument, a tombstone in it is an error: merge would delete the key.
 func km_merge(km_updated keymap, fs ...interface{}) (keymap, error) {
     f := fs[0].(vfile)
-    km_flat, _ := flat.Flatten(f.obj, nil)
+    km_flat, err := flatten(f.obj, f.layout.arrays)
+    if err != nil {
+        return km_updated, file_error{path.Join(f.root_path, f.path), 0, 0, err}
+    }
+    if len(fs) > 1 && fs[1].(bool) {
+        errs := error_list{}
+        for _, p := range order_keys(km_flat, []string{}) {
+            if km_flat[p] == tombstone {
+                err := fmt.Errorf("%s: %q is reserved for the keys and set items carver deletes", p, tombstone)
+                errs = errs.add(file_error{path.Join(f.root_path, f.path), 0, 0, err})
+            }
+        }
+        if len(errs) > 0 {
+            return km_updated, errs.err()
+        }
+    }
     for path, value := range km_flat {
         kmn := km_updated.get_node(path, value)
         kmn.Count++
@@ -109,47 +638,52 @@ func km_merge(km_updated keymap, fs ...interface{}) (keymap, error) {
 }
 
 func normalize(km keymap, args ...interface{}) (keymap, error) {
-    common_name := args[0].(string)
-    num_files := args[1].(int)
+    l := args[0].(layer)
+    subsets := []layer{}
+    if len(args) > 1 {
+        subsets = args[1].([]layer)
+    }
+    pol := policy{}
+    if len(args) > 2 {
+        pol = args[2].(policy)
+    }
     for p := range km {
-        for t := range km[p] {
-            for vStr := range km[p][t] {
-                kmn := km[p][t][vStr]
-                var v interface{}
-                json.Unmarshal([]byte(vStr), &v)
-                if kmn.Count == num_files {
-                    kmn.Paths = map[string]interface{}{
-                        common_name: map[string]interface{}{},
-                    }
-                }
-                km[p][t][vStr] = kmn
-            }
-        }
+        assigned := map[string]km_value{}
+        l.assign(km.values(p), km_value{}, assigned, pol)
+        hoist(assigned, subsets)
+        km = km.set_values(p, assigned)
     }
     return km, nil
 }
 
+// resolve gives each leaf the value from the most specific layer in its stack.
+// a leaf whose most specific value is a tombstone doesn't get the key at all.
 func resolve(km keymap, args ...interface{}) (keymap, error) {
-    common_name := args[0].(string)
-    names := args[1].([]string)
-    num_files := len(names)
-    paths_new := map[string]interface{}{}
-    for _, name := range names {
-        if name == common_name {
-            continue
-        }
-        paths_new[name] = map[string]interface{}{}
+    l := args[0].(layer)
+    subsets := []layer{}
+    if len(args) > 1 {
+        subsets = args[1].([]layer)
     }
+    stacks := stack_subsets(l.stacks(), subsets)
     for p := range km {
-        for t := range km[p] {
-            for vStr := range km[p][t] {
-                kmn := km[p][t][vStr]
-                _, err := kmn.Paths[common_name]
-                if err {
-                    kmn.Paths = paths_new
-                    kmn.Count = num_files
-                } else {
+        values := km.values(p)
+        resolved := map[string]km_value{}
+        for leaf, stack := range stacks {
+            for i := len(stack) - 1; i >= 0; i-- {
+                v, ok := values[stack[i]]
+                if ok && v == tombstone_value {
+                    break
+                }
+                if ok {
+                    resolved[leaf] = v
+                    break
                 }
+            }
+        }
+        km = km.set_values(p, resolved)
+        for t := range km[p] {
+            for vStr, kmn := range km[p][t] {
+                kmn.Count = len(kmn.Paths)
                 km[p][t][vStr] = kmn
             }
         }
@@ -1,4 +1,4 @@
-package main
+package carver
 
 import (
     // "fmt"
@@ -113,7 +113,7 @@ func TestTypeToString(t * testing.T) {
             map[string]string{
                 "foo": "bar",
             },
-            "string",
+            "object",
         },
         "base": {
             "foo",
@@ -123,6 +123,22 @@ func TestTypeToString(t * testing.T) {
             true,
             "bool",
         },
+        "null": {
+            nil,
+            "null",
+        },
+        "array": {
+            []interface{}{},
+            "array",
+        },
+        "int": {
+            json.Number("9007199254740993"),
+            "int",
+        },
+        "number": {
+            json.Number("1.0"),
+            "number",
+        },
     }
     runTestsOneArgParallel[any, string](t, type_to_string, testCases)
 }
@@ -168,7 +184,9 @@ func TestKeyMapGetNode(t * testing.T) {
                     "paths": {
                         "example.json": {}
                     }
-                },
+                }
+            },
+            "array": {
                 "[1,2]": {
                     "count": 1,
                     "paths": {
@@ -225,15 +243,17 @@ func TestKeyMapBind(t * testing.T) {
         "empty": {
             unmarshal([]byte(`{}`)),
             []interface{}{
-                file{
+                vfile{
                     "exampleTest.json",
+                    ".",
                     "exampleTest.json",
                     map[string]interface{}{},
+                    layout{},
                 },
             },
             unmarshal([]byte(`{
                 "": {
-                    "string": {
+                    "object": {
                         "{}": {
                             "count": 1,
                             "paths": {
@@ -247,16 +267,18 @@ func TestKeyMapBind(t * testing.T) {
         "string": {
             unmarshal([]byte(`{}`)),
             []interface{}{
-                file{
+                vfile{
                     "exampleTest.json",
+                    ".",
                     "exampleTest.json",
                     map[string]interface{}{
                         "foo": "biz",
                     },
+                    layout{},
                 },
             },
             unmarshal([]byte(`{
-                "foo": {
+                "/foo": {
                     "string": {
                         "\"biz\"": {
                             "count": 1,
@@ -271,17 +293,19 @@ func TestKeyMapBind(t * testing.T) {
         "list": {
             unmarshal([]byte(`{}`)),
             []interface{}{
-                file{
+                vfile{
                     "exampleTest.json",
+                    ".",
                     "exampleTest.json",
                     map[string]interface{}{
                         "foo": []int{1, 2},
                     },
+                    layout{},
                 },
             },
             unmarshal([]byte(`{
-                "foo": {
-                    "string": {
+                "/foo": {
+                    "array": {
                         "[1,2]": {
                             "count": 1,
                             "paths": {
@@ -295,18 +319,20 @@ func TestKeyMapBind(t * testing.T) {
         "nested_string": {
             unmarshal([]byte(`{}`)),
             []interface{}{
-                file{
+                vfile{
                     "exampleTest.json",
+                    ".",
                     "exampleTest.json",
                     map[string]interface{}{
                         "biz": map[string]interface{}{
                             "baz": "bar",
                         },
                     },
+                    layout{},
                 },
             },
             unmarshal([]byte(`{
-                "biz.baz": {
+                "/biz/baz": {
                     "string": {
                         "\"bar\"": {
                             "count": 1,
@@ -342,8 +368,7 @@ func TestNormalizeBind(t * testing.T) {
                 }
             }`)),
             []interface{}{
-                "common.json",
-                1,
+                new_layer("common.json", []string{"exampleTest.json"}),
             },
             unmarshal([]byte(`{
                 "foo": {
@@ -382,11 +407,13 @@ func TestResolveBind(t * testing.T) {
                 }
             }`)),
             []interface{}{
-                "common.json",
-                []string{
-                    "exampleTest.json",
+                new_layer(
                     "common.json",
-                },
+                    []string{
+                        "exampleTest.json",
+                        "common.json",
+                    },
+                ),
             },
             unmarshal([]byte(`{
                 "foo": {
@@ -412,3 +439,398 @@ func TestResolveBind(t * testing.T) {
   }
   runTestsMonad[keymap, interface{}, keymap](t, f_bind, testCases)
 }
+
+func TestNewLayerTree(t * testing.T) {
+    testCases := map[string]testCaseOneArg[[]string, layer]{
+        "flat": {
+            []string{"dev", "prod"},
+            layer{".", []layer{
+                layer{"dev", []layer{}},
+                layer{"prod", []layer{}},
+            }},
+        },
+        "nested": {
+            []string{"dev", "prod/us-east/canary", "prod/us-east/main", "prod/eu-west"},
+            layer{".", []layer{
+                layer{"dev", []layer{}},
+                layer{"prod", []layer{
+                    layer{"prod/us-east", []layer{
+                        layer{"prod/us-east/canary", []layer{}},
+                        layer{"prod/us-east/main", []layer{}},
+                    }},
+                    layer{"prod/eu-west", []layer{}},
+                }},
+            }},
+        },
+    }
+    f := func(names []string) layer {
+        l, _ := new_layer_tree(".", names)
+        return l
+    }
+    runTestsOneArgParallel[[]string, layer](t, f, testCases)
+    _, err := new_layer_tree(".", []string{"prod", "prod/us-east"})
+    if err == nil {
+        t.Fatalf(`expected an error for an env inside another env`)
+    }
+}
+
+func TestLayerPrune(t * testing.T) {
+    l, _ := new_layer_tree("c", []string{"dev", "prod/a", "prod/b"})
+    testCases := map[string]testCaseOneArg[[]string, layer]{
+        "all": {
+            []string{"dev", "prod/a", "prod/b"},
+            l,
+        },
+        "missing_prod_leaf": {
+            []string{"dev", "prod/a"},
+            layer{"", []layer{
+                layer{"dev", []layer{}},
+                layer{"", []layer{
+                    layer{"prod/a", []layer{}},
+                }},
+            }},
+        },
+        "missing_dev": {
+            []string{"prod/a", "prod/b"},
+            layer{"", []layer{
+                layer{"prod", []layer{
+                    layer{"prod/a", []layer{}},
+                    layer{"prod/b", []layer{}},
+                }},
+            }},
+        },
+    }
+    runTestsOneArgParallel[[]string, layer](t, l.prune, testCases)
+}
+
+func TestNormalizeTreeBind(t * testing.T) {
+    l, _ := new_layer_tree("c", []string{"dev", "prod/a", "prod/b"})
+    testCases := map[string]testCaseMonad[keymap, interface{}, keymap]{
+        "layers": {
+            unmarshal([]byte(`{
+                "foo": {
+                    "string": {
+                        "\"bar\"": {
+                            "count": 3,
+                            "paths": {"dev": {}, "prod/a": {}, "prod/b": {}}
+                        }
+                    }
+                },
+                "tls": {
+                    "bool": {
+                        "false": {
+                            "count": 1,
+                            "paths": {"dev": {}}
+                        },
+                        "true": {
+                            "count": 2,
+                            "paths": {"prod/a": {}, "prod/b": {}}
+                        }
+                    }
+                },
+                "region": {
+                    "string": {
+                        "\"a\"": {
+                            "count": 1,
+                            "paths": {"prod/a": {}}
+                        }
+                    }
+                }
+            }`)),
+            []interface{}{l},
+            unmarshal([]byte(`{
+                "foo": {
+                    "string": {
+                        "\"bar\"": {
+                            "count": 3,
+                            "paths": {"c": {}}
+                        }
+                    }
+                },
+                "tls": {
+                    "bool": {
+                        "false": {
+                            "count": 1,
+                            "paths": {"dev": {}}
+                        },
+                        "true": {
+                            "count": 2,
+                            "paths": {"prod": {}}
+                        }
+                    }
+                },
+                "region": {
+                    "string": {
+                        "\"a\"": {
+                            "count": 1,
+                            "paths": {"prod/a": {}}
+                        }
+                    }
+                }
+            }`)),
+        },
+  }
+  f_bind := func(km keymap, args ...interface{})(keymap, error) {
+      m1 := monad{nil, km, []string{}}.bind(normalize, args...)
+      return m1.km, m1.err
+  }
+  runTestsMonad[keymap, interface{}, keymap](t, f_bind, testCases)
+}
+
+func TestResolveTreeBind(t * testing.T) {
+    l, _ := new_layer_tree("c", []string{"dev", "prod/a", "prod/b"})
+    testCases := map[string]testCaseMonad[keymap, interface{}, keymap]{
+        "layers": {
+            unmarshal([]byte(`{
+                "foo": {
+                    "string": {
+                        "\"bar\"": {
+                            "count": 3,
+                            "paths": {"c": {}}
+                        }
+                    }
+                },
+                "tls": {
+                    "bool": {
+                        "false": {
+                            "count": 1,
+                            "paths": {"dev": {}}
+                        },
+                        "true": {
+                            "count": 2,
+                            "paths": {"prod": {}}
+                        }
+                    }
+                }
+            }`)),
+            []interface{}{l},
+            unmarshal([]byte(`{
+                "foo": {
+                    "string": {
+                        "\"bar\"": {
+                            "count": 3,
+                            "paths": {"dev": {}, "prod/a": {}, "prod/b": {}}
+                        }
+                    }
+                },
+                "tls": {
+                    "bool": {
+                        "false": {
+                            "count": 1,
+                            "paths": {"dev": {}}
+                        },
+                        "true": {
+                            "count": 2,
+                            "paths": {"prod/a": {}, "prod/b": {}}
+                        }
+                    }
+                }
+            }`)),
+        },
+  }
+  f_bind := func(km keymap, args ...interface{})(keymap, error) {
+      m1 := monad{nil, km, []string{}}.bind(resolve, args...)
+      return m1.km, m1.err
+  }
+  runTestsMonad[keymap, interface{}, keymap](t, f_bind, testCases)
+}
+
+func TestChooseSubsets(t * testing.T) {
+    testCases := map[string]testCaseOneArg[[][]string, [][]string]{
+        "none": {
+            [][]string{{"dev", "test"}},
+            [][]string{},
+        },
+        "exact": {
+            [][]string{{"dev", "test"}, {"dev", "test"}, {"prod", "staging"}},
+            [][]string{{"dev", "test"}},
+        },
+        "superset": {
+            [][]string{{"dev", "test"}, {"dev", "test"}, {"dev", "staging", "test"}},
+            [][]string{{"dev", "test"}},
+        },
+    }
+    f := func(sets [][]string) [][]string {
+        return choose_subsets(sets, 2)
+    }
+    runTestsOneArgParallel[[][]string, [][]string](t, f, testCases)
+}
+
+func TestNormalizeSubsetsBind(t * testing.T) {
+    l := new_layer("c", []string{"dev", "staging", "prod"})
+    subsets := []layer{new_subset("non-prod", []string{"dev", "staging"})}
+    km := []byte(`{
+        "tls": {
+            "bool": {
+                "false": {
+                    "count": 2,
+                    "paths": {"dev": {}, "staging": {}}
+                },
+                "true": {
+                    "count": 1,
+                    "paths": {"prod": {}}
+                }
+            }
+        }
+    }`)
+    normalized := []byte(`{
+        "tls": {
+            "bool": {
+                "false": {
+                    "count": 2,
+                    "paths": {"non-prod": {}}
+                },
+                "true": {
+                    "count": 1,
+                    "paths": {"prod": {}}
+                }
+            }
+        }
+    }`)
+    testCases := map[string]testCaseMonad[keymap, interface{}, keymap]{
+        "normalize": {
+            unmarshal(km),
+            []interface{}{l, subsets},
+            unmarshal(normalized),
+        },
+    }
+    f_bind := func(km keymap, args ...interface{})(keymap, error) {
+        m1 := monad{nil, km, []string{}}.bind(normalize, args...)
+        return m1.km, m1.err
+    }
+    runTestsMonad[keymap, interface{}, keymap](t, f_bind, testCases)
+    resolved, _ := resolve(unmarshal(normalized), l, subsets)
+    if ! reflect.DeepEqual(resolved, unmarshal(km)) {
+        t.Fatalf(`expected subsets to resolve back, got %v`, resolved)
+    }
+}
+
+func TestTombstonesBind(t * testing.T) {
+    l := new_layer("c", []string{"dev", "staging", "test", "prod"})
+    km := []byte(`{
+        "featureB": {
+            "bool": {
+                "true": {
+                    "count": 3,
+                    "paths": {"dev": {}, "staging": {}, "test": {}}
+                }
+            }
+        },
+        "new_feature": {
+            "bool": {
+                "true": {
+                    "count": 2,
+                    "paths": {"dev": {}, "test": {}}
+                }
+            }
+        }
+    }`)
+    normalized := []byte(`{
+        "featureB": {
+            "bool": {
+                "true": {
+                    "count": 3,
+                    "paths": {"c": {}}
+                }
+            },
+            "string": {
+                "\"$delete\"": {
+                    "count": 1,
+                    "paths": {"prod": {}}
+                }
+            }
+        },
+        "new_feature": {
+            "bool": {
+                "true": {
+                    "count": 2,
+                    "paths": {"dev": {}, "test": {}}
+                }
+            }
+        }
+    }`)
+    testCases := map[string]testCaseMonad[keymap, interface{}, keymap]{
+        "off": {
+            unmarshal(km),
+            []interface{}{l, []layer{}, policy{}},
+            unmarshal(km),
+        },
+        "on": {
+            unmarshal(km),
+            []interface{}{l, []layer{}, policy{tombstones: true}},
+            unmarshal(normalized),
+        },
+    }
+    f_bind := func(km keymap, args ...interface{})(keymap, error) {
+        m1 := monad{nil, km, []string{}}.bind(normalize, args...)
+        return m1.km, m1.err
+    }
+    runTestsMonad[keymap, interface{}, keymap](t, f_bind, testCases)
+    resolved, _ := resolve(unmarshal(normalized), l)
+    if ! reflect.DeepEqual(resolved, unmarshal(km)) {
+        t.Fatalf(`expected tombstones to resolve back, got %v`, resolved)
+    }
+}
+
+func TestThresholdBind(t * testing.T) {
+    l := new_layer("c", []string{"a", "b", "c1", "d"})
+    km := []byte(`{
+        "replicas": {
+            "string": {
+                "3": {
+                    "count": 3,
+                    "paths": {"a": {}, "b": {}, "c1": {}}
+                },
+                "5": {
+                    "count": 1,
+                    "paths": {"d": {}}
+                }
+            }
+        }
+    }`)
+    normalized := []byte(`{
+        "replicas": {
+            "string": {
+                "3": {
+                    "count": 3,
+                    "paths": {"c": {}}
+                },
+                "5": {
+                    "count": 1,
+                    "paths": {"d": {}}
+                }
+            }
+        }
+    }`)
+    testCases := map[string]testCaseMonad[keymap, interface{}, keymap]{
+        "all": {
+            unmarshal(km),
+            []interface{}{l, []layer{}, policy{}},
+            unmarshal(km),
+        },
+        "below": {
+            unmarshal(km),
+            []interface{}{l, []layer{}, policy{threshold: 0.8}},
+            unmarshal(km),
+        },
+        "above": {
+            unmarshal(km),
+            []interface{}{l, []layer{}, policy{threshold: 0.75}},
+            unmarshal(normalized),
+        },
+        "most": {
+            unmarshal(km),
+            []interface{}{l, []layer{}, policy{most: true}},
+            unmarshal(normalized),
+        },
+    }
+    f_bind := func(km keymap, args ...interface{})(keymap, error) {
+        m1 := monad{nil, km, []string{}}.bind(normalize, args...)
+        return m1.km, m1.err
+    }
+    runTestsMonad[keymap, interface{}, keymap](t, f_bind, testCases)
+    resolved, _ := resolve(unmarshal(normalized), l)
+    if ! reflect.DeepEqual(resolved, unmarshal(km)) {
+        t.Fatalf(`expected overrides to win over the common value, got %v`, resolved)
+    }
+}
@@ -0,0 +1,150 @@
+package carver
+
+import (
+    "context"
+    "fmt"
+    "path"
+    "sort"
+    "encoding/json"
+)
+
+// check resolves the normalized dir and normalizes the config dir, both in
+// memory, and describes every way the dirs on disk differ from the results.
+// files that can't be read are reported as problems and their groups are
+// skipped. errors that stop the check altogether are returned. jobs is the
+// size of the worker pool of the merge and normalize runs.
+func check(ctx context.Context, config opts, pol policy, c root, n root, jobs int) ([]string, error) {
+    problems := []string{}
+
+    // when files can't be read, the files of their groups are missing from
+    // the results, so only the errors are reported
+    merged, _, err := merge_dir(ctx, config, n, true, jobs)
+    if ctx.Err() != nil {
+        return problems, ctx.Err()
+    }
+    problems = append(problems, error_problems(err)...)
+    g, err := new_group(config, c)
+    if err != nil {
+        return problems, err
+    }
+    config_fm, err := g.get_file_map(false)
+    if err != nil {
+        return problems, err
+    }
+    if len(problems) == 0 {
+        problems = append(problems, check_files(c, merged, config_fm, "merge")...)
+    }
+
+    if config.Subsets == "suggest" {
+        config.Subsets = ""
+    }
+    normalized, _, _, _, err := normalize_dir(ctx, config, pol, c, true, jobs)
+    if ctx.Err() != nil {
+        return problems, ctx.Err()
+    }
+    load_problems := error_problems(err)
+    problems = append(problems, load_problems...)
+    g, err = new_group(config, n)
+    if err != nil {
+        return problems, err
+    }
+    g.add_subsets(g.find_subsets())
+    normalized_fm, err := g.get_file_map(true)
+    if err != nil {
+        // merge_dir read the same dirs, and reported the error already
+        return problems, nil
+    }
+    if len(load_problems) == 0 {
+        problems = append(problems, check_files(n, normalized, normalized_fm, "normalize")...)
+    }
+
+    return problems, nil
+}
+
+func error_problems(err error) []string {
+    problems := []string{}
+    for _, e := range errors_of(err) {
+        problems = append(problems, e.Error())
+    }
+    return problems
+}
+
+// list_files returns every file in the file map, sorted
+func (fm file_map) list_files() []string {
+    file_paths := []string{}
+    for _, paths := range fm.paths {
+        for _, file_path := range paths {
+            file_paths = append(file_paths, path.Clean(file_path))
+        }
+    }
+    sort.Strings(file_paths)
+    return file_paths
+}
+
+// check_files compares the files of a file map with the files a command
+// expects to write there
+func check_files(r root, expected map[string]map[string]interface{}, fm file_map, command string) []string {
+    problems := []string{}
+    names := []string{}
+    for name := range expected {
+        names = append(names, name)
+    }
+    seen := map[string]bool{}
+    for _, name := range fm.list_files() {
+        seen[name] = true
+        if _, ok := expected[name]; !ok {
+            problems = append(problems, fmt.Sprintf("%s: not produced by %s", r.file_path(name), command))
+        }
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        file_path := r.file_path(name)
+        if !seen[name] {
+            problems = append(problems, fmt.Sprintf("%s: missing, %s would create it", file_path, command))
+            continue
+        }
+        f, err := new_file(r, name, fm.arrays)
+        if err != nil {
+            continue
+        }
+        actual, err := flatten(f.obj, fm.arrays)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("%s: %s", file_path, err))
+            continue
+        }
+        for _, diff := range diff_keys(expected[name], actual) {
+            problems = append(problems, fmt.Sprintf("%s: %s", file_path, diff))
+        }
+    }
+    return problems
+}
+
+// diff_keys describes the keys whose values differ between two flat objects
+func diff_keys(expected map[string]interface{}, actual map[string]interface{}) []string {
+    keys := []string{}
+    for k := range expected {
+        keys = append(keys, k)
+    }
+    for k := range actual {
+        if _, ok := expected[k]; !ok {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+    diffs := []string{}
+    for _, k := range keys {
+        e, e_ok := expected[k]
+        a, a_ok := actual[k]
+        e_bytes, _ := json.Marshal(e)
+        a_bytes, _ := json.Marshal(a)
+        switch {
+        case !a_ok:
+            diffs = append(diffs, fmt.Sprintf("%s: missing, expected %s", k, e_bytes))
+        case !e_ok:
+            diffs = append(diffs, fmt.Sprintf("%s: unexpected value %s", k, a_bytes))
+        case string(e_bytes) != string(a_bytes):
+            diffs = append(diffs, fmt.Sprintf("%s: expected %s, got %s", k, e_bytes, a_bytes))
+        }
+    }
+    return diffs
+}
@@ -0,0 +1,38 @@
+package carver
+
+import (
+    "context"
+    "testing"
+)
+
+func TestDiffKeys(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[map[string]interface{}, map[string]interface{}, []string]{
+        "same": {
+            map[string]interface{}{"foo": "bar"},
+            map[string]interface{}{"foo": "bar"},
+            []string{},
+        },
+        "changed": {
+            map[string]interface{}{"foo": "bar", "tls": true},
+            map[string]interface{}{"foo": "baz", "tls": true},
+            []string{`foo: expected "bar", got "baz"`},
+        },
+        "missing_and_unexpected": {
+            map[string]interface{}{"a": 1.0},
+            map[string]interface{}{"b": false},
+            []string{`a: missing, expected 1`, `b: unexpected value false`},
+        },
+    }
+    runTestsTwoArgsParallel[map[string]interface{}, map[string]interface{}, []string](t, diff_keys, testCases)
+}
+
+func TestCheckStack(t * testing.T) {
+    for _, root := range []string{"test_stack/test1", "test_stack/test3", "test_stack/test4", "test_stack/test5"} {
+        config, _ := load_opts(os_root(root))
+        pol, _ := config.get_policy()
+        problems, err := check(context.Background(), config, pol, os_root(root), os_root(root + "/.carver"), 0)
+        if err != nil || len(problems) > 0 {
+            t.Fatalf(`expected %s to check out, got %v`, root, problems)
+        }
+    }
+}
@@ -0,0 +1,354 @@
+// the carver command normalizes and merges config trees with the carver
+// package
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+
+    "github.com/rsutton1/carver"
+)
+
+func printUsage() {
+    fmt.Println(`usage: carver [options] command
+
+  command:
+    normalize          normalize CONFIG_DIR and store the result in NORMALIZED_DIR
+    merge              merge NORMALIZED_DIR and store the result in CONFIG_DIR
+    check              verify that NORMALIZED_DIR merges back into CONFIG_DIR
+                       and is in normalized form, without writing anything
+    help               print this message
+
+  options:
+    -c CONFIG_DIR      configuration directory, or a .zip, .tar, .tar.gz or
+                       .tgz archive of one, which is read without unpacking
+                       it; its normalized directory is the .carver directory
+                       in the archive unless -n is given
+    -n NORMALIZED_DIR  normalized directory
+    -to ARCHIVE        write the files to a new .zip or .tar archive instead
+                       of a directory; required when -c is an archive
+                       (normalize and merge only)
+    -dry-run           print a diff of the changes instead of writing them
+                       (normalize and merge only)
+    -keep-going        when files can't be read, still write every file that
+                       doesn't depend on them, then report the errors
+                       (normalize and merge only)
+    -prune             delete the files an earlier run wrote that this run
+                       doesn't, as listed in the .carver-manifest of the
+                       output directory; files carver didn't write are never
+                       touched (normalize and merge only)
+    -o FORMAT          report the files written as text, one line each, or
+                       as json; with -dry-run, text is a diff and json lists
+                       the changes that would be made (normalize and merge
+                       only)
+    -threshold VALUE   promote values that this share of envs agree on, as a
+                       percentage like 90%, or "most" for the most common
+                       value (normalize and check only)
+    -j N               read and build up to N groups of files at once, one
+                       per CPU by default
+    `)
+}
+
+func main() {
+    var c string
+    var n string
+    var threshold string
+    var dry_run bool
+    var keep_going bool
+    var prune bool
+    var output string
+    var to string
+    var jobs int
+    normalizeCmd := flag.NewFlagSet("normalize", flag.ExitOnError)
+    normalizeCmd.StringVar(&c, "c", "./", "config directory")
+    normalizeCmd.StringVar(&n, "n", "./.carver/", "normalized directory")
+    normalizeCmd.StringVar(&threshold, "threshold", "", "share of envs that must agree on a value")
+    normalizeCmd.BoolVar(&dry_run, "dry-run", false, "print a diff instead of writing files")
+    normalizeCmd.BoolVar(&keep_going, "keep-going", false, "write the files that don't depend on broken ones")
+    normalizeCmd.BoolVar(&prune, "prune", false, "delete the files carver wrote before but no longer writes")
+    normalizeCmd.StringVar(&output, "o", "text", "report format, text or json")
+    normalizeCmd.StringVar(&to, "to", "", "archive to write the files to")
+    normalizeCmd.IntVar(&jobs, "j", 0, "groups of files built at once, one per CPU when 0")
+    mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+    mergeCmd.StringVar(&c, "c", "./", "config directory")
+    mergeCmd.StringVar(&n, "n", "./.carver/", "normalized directory")
+    mergeCmd.BoolVar(&dry_run, "dry-run", false, "print a diff instead of writing files")
+    mergeCmd.BoolVar(&keep_going, "keep-going", false, "write the files that don't depend on broken ones")
+    mergeCmd.BoolVar(&prune, "prune", false, "delete the files carver wrote before but no longer writes")
+    mergeCmd.StringVar(&output, "o", "text", "report format, text or json")
+    mergeCmd.StringVar(&to, "to", "", "archive to write the files to")
+    mergeCmd.IntVar(&jobs, "j", 0, "groups of files built at once, one per CPU when 0")
+    checkCmd := flag.NewFlagSet("check", flag.ExitOnError)
+    checkCmd.StringVar(&c, "c", "./", "config directory")
+    checkCmd.StringVar(&n, "n", "./.carver/", "normalized directory")
+    checkCmd.StringVar(&threshold, "threshold", "", "share of envs that must agree on a value")
+    checkCmd.IntVar(&jobs, "j", 0, "groups of files built at once, one per CPU when 0")
+    if len(os.Args) < 2 {
+        printUsage()
+        os.Exit(1)
+    }
+    sub_args := os.Args[2:]
+    var errs []error
+    var report carver.Report
+    switch os.Args[1] {
+    case "normalize":
+        normalizeCmd.Parse(sub_args)
+        errs = check_output(output)
+        if len(errs) == 0 {
+            n = normalized_flag(normalizeCmd, c, n)
+            report, errs = normalize_cmd(c, n, to, threshold, jobs, dry_run, keep_going, prune)
+            print_report(report, output, dry_run)
+        }
+    case "merge":
+        mergeCmd.Parse(sub_args)
+        errs = check_output(output)
+        if len(errs) == 0 {
+            n = normalized_flag(mergeCmd, c, n)
+            report, errs = merge_cmd(c, n, to, jobs, dry_run, keep_going, prune)
+            print_report(report, output, dry_run)
+        }
+    case "check":
+        checkCmd.Parse(sub_args)
+        n = normalized_flag(checkCmd, c, n)
+        var problems []string
+        problems, errs = check_cmd(c, n, threshold, jobs)
+        for _, problem := range problems {
+            fmt.Println(problem)
+        }
+        if len(errs) == 0 && len(problems) > 0 {
+            os.Exit(1)
+        }
+    default:
+        printUsage()
+    }
+    if len(errs) > 0 {
+        for _, err := range errs {
+            fmt.Fprintln(os.Stderr, err)
+        }
+        os.Exit(1)
+    }
+}
+
+// errors_of lists the errors of a run, leaving out the missing ones
+func errors_of(errs ...error) []error {
+    present := []error{}
+    for _, err := range errs {
+        if err != nil {
+            present = append(present, err)
+        }
+    }
+    return present
+}
+
+// check_output validates the -o flag
+func check_output(output string) []error {
+    if output != "text" && output != "json" {
+        return errors_of(fmt.Errorf("unknown output format %q, expected text or json", output))
+    }
+    return nil
+}
+
+// print_report prints what a run did in the format of the -o flag. a dry run
+// prints a diff in place of the text report.
+func print_report(report carver.Report, output string, dry_run bool) {
+    switch {
+    case output == "json":
+        fmt.Print(report.JSON())
+    case dry_run:
+        fmt.Print(report.Diff())
+    default:
+        fmt.Print(report.Text())
+    }
+}
+
+// print_suggested writes the suggested layers to stderr, where they stay out
+// of a json report on stdout
+func print_suggested(suggested map[string][]string) {
+    if len(suggested) == 0 {
+        fmt.Fprintln(os.Stderr, "no layers to suggest")
+        return
+    }
+    names := []string{}
+    for name := range suggested {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    fmt.Fprintln(os.Stderr, "suggested layers:")
+    fmt.Fprintln(os.Stderr, "layers:")
+    for _, name := range names {
+        fmt.Fprintf(os.Stderr, "  %s:\n", name)
+        for _, env := range suggested[name] {
+            fmt.Fprintf(os.Stderr, "   - %s\n", env)
+        }
+    }
+}
+
+// is_archive reports whether -c names an archive rather than a directory
+func is_archive(c string) bool {
+    for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+        if strings.HasSuffix(c, ext) {
+            return true
+        }
+    }
+    return false
+}
+
+// normalized_flag is the -n flag, or "" when -c is an archive and -n isn't
+// given, so that the normalized tree is the one in the archive
+func normalized_flag(cmd * flag.FlagSet, c string, n string) string {
+    set := false
+    cmd.Visit(func(f * flag.Flag) {
+        set = set || f.Name == "n"
+    })
+    if is_archive(c) && !set {
+        return ""
+    }
+    return n
+}
+
+// load_tree reads the config tree of -c from a directory or an archive
+func load_tree(c string) (carver.Tree, error) {
+    if !is_archive(c) {
+        return carver.LoadTree(c)
+    }
+    if strings.HasSuffix(c, ".zip") {
+        // read into memory like a tar archive, so there's no file to close
+        b, err := os.ReadFile(c)
+        if err != nil {
+            return carver.Tree{Dir: c}, err
+        }
+        zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+        if err != nil {
+            return carver.Tree{Dir: c}, fmt.Errorf("%s: %s", c, err)
+        }
+        return carver.LoadTreeFS(zr, ".")
+    }
+    f, err := os.Open(c)
+    if err != nil {
+        return carver.Tree{Dir: c}, err
+    }
+    defer f.Close()
+    var r io.Reader = f
+    if !strings.HasSuffix(c, ".tar") {
+        gz, err := gzip.NewReader(f)
+        if err != nil {
+            return carver.Tree{Dir: c}, fmt.Errorf("%s: %s", c, err)
+        }
+        r = gz
+    }
+    fsys, err := carver.TarFS(r)
+    if err != nil {
+        return carver.Tree{Dir: c}, fmt.Errorf("%s: %s", c, err)
+    }
+    return carver.LoadTreeFS(fsys, ".")
+}
+
+// output_sink is the archive of -to, which is nil when the files go to their
+// directory. nothing is written to it on a dry run.
+func output_sink(c string, to string, dry_run bool) (carver.Sink, * os.File, error) {
+    switch {
+    case to == "" && is_archive(c):
+        return nil, nil, fmt.Errorf("%s is an archive, name an archive to write to with -to", c)
+    case to == "":
+        return nil, nil, nil
+    case !strings.HasSuffix(to, ".zip") && !strings.HasSuffix(to, ".tar"):
+        return nil, nil, fmt.Errorf("unknown archive %s, expected a .zip or .tar file", to)
+    case dry_run:
+        return carver.TarSink(io.Discard), nil, nil
+    }
+    f, err := os.Create(to)
+    if err != nil {
+        return nil, nil, err
+    }
+    if strings.HasSuffix(to, ".zip") {
+        return carver.ZipSink(f), f, nil
+    }
+    return carver.TarSink(f), f, nil
+}
+
+// write_or_plan writes the files, or only plans the changes on a dry run
+func write_or_plan(f carver.Files, dry_run bool, prune bool) (carver.Report, error) {
+    if dry_run {
+        return f.Plan(prune)
+    }
+    return f.Write(prune)
+}
+
+// write_to writes the files, closing the archive of -to. the archive is
+// removed again if the files can't be written.
+func write_to(f carver.Files, archive * os.File, dry_run bool, prune bool) (carver.Report, []error) {
+    report, err := write_or_plan(f, dry_run, prune)
+    if archive != nil {
+        return report, errors_of(err, close_archive(archive, err))
+    }
+    return report, errors_of(err)
+}
+
+// close_archive closes the archive of -to, removing it after an error
+func close_archive(archive * os.File, err error) error {
+    close_err := archive.Close()
+    if err != nil || close_err != nil {
+        os.Remove(archive.Name())
+    }
+    return close_err
+}
+
+func normalize_cmd(c string, n string, to string, threshold string, jobs int, dry_run bool, keep_going bool, prune bool) (carver.Report, []error) {
+    tree, err := load_tree(c)
+    if err != nil {
+        return nil, errors_of(err)
+    }
+    sink, archive, err := output_sink(c, to, dry_run)
+    if err != nil {
+        return nil, errors_of(err)
+    }
+    normalized, err := carver.Normalize(context.Background(), tree, carver.Options{NormalizedDir: n, Threshold: threshold, KeepGoing: keep_going, Jobs: jobs, Output: sink})
+    if normalized.Suggested != nil {
+        print_suggested(normalized.Suggested)
+    }
+    if err != nil && !keep_going {
+        if archive != nil {
+            close_archive(archive, err)
+        }
+        return nil, errors_of(err)
+    }
+    report, write_errs := write_to(normalized.Files, archive, dry_run, prune)
+    return report, append(errors_of(err), write_errs...)
+}
+
+func merge_cmd(c string, n string, to string, jobs int, dry_run bool, keep_going bool, prune bool) (carver.Report, []error) {
+    tree, err := load_tree(c)
+    if err != nil {
+        return nil, errors_of(err)
+    }
+    sink, archive, err := output_sink(c, to, dry_run)
+    if err != nil {
+        return nil, errors_of(err)
+    }
+    merged, err := carver.Merge(context.Background(), tree, carver.Options{NormalizedDir: n, KeepGoing: keep_going, Jobs: jobs, Output: sink})
+    if err != nil && !keep_going {
+        if archive != nil {
+            close_archive(archive, err)
+        }
+        return nil, errors_of(err)
+    }
+    report, write_errs := write_to(merged.Files, archive, dry_run, prune)
+    return report, append(errors_of(err), write_errs...)
+}
+
+func check_cmd(c string, n string, threshold string, jobs int) ([]string, []error) {
+    tree, err := load_tree(c)
+    if err != nil {
+        return []string{}, errors_of(err)
+    }
+    problems, err := carver.Check(context.Background(), tree, carver.Options{NormalizedDir: n, Threshold: threshold, Jobs: jobs})
+    return problems, errors_of(err)
+}
@@ -0,0 +1,211 @@
+package carver
+
+import (
+    "bytes"
+    "fmt"
+    "path"
+    "strings"
+    "encoding/json"
+    "gopkg.in/yaml.v3"
+)
+
+// a codec reads and writes one file format. files are matched to a codec by
+// their extension, and files without one by their content.
+type codec interface {
+    // name names the format, e.g. "json"
+    name() string
+    // exts are the extensions of the format, e.g. ".yaml" and ".yml"
+    exts() []string
+    // sniff reports whether b looks like a document in this format
+    sniff(b []byte) bool
+    // decode decodes a document into the same shape as json, with numbers
+    // as json.Number
+    decode(b []byte) (map[string]interface{}, error)
+    // decode_error places an error of decode in the file at path
+    decode_error(path string, b []byte, err error) error
+    // read_layout reads the layout of a document
+    read_layout(b []byte) layout
+    // default_layout is the layout of a file that doesn't exist yet
+    default_layout() layout
+    encode(doc *doc_node, l layout) ([]byte, error)
+}
+
+// codecs are the formats carver knows, in the order their content is
+// sniffed
+var codecs = []codec{json_codec{}, yaml_codec{}, toml_codec{}, dotenv_codec{}, properties_codec{}}
+
+// codec_for finds the codec of the file name by its extension, or when it has
+// none, by its content b
+func codec_for(name string, b []byte) (codec, error) {
+    ext := path.Ext(name)
+    if ext != "" {
+        for _, c := range codecs {
+            for _, e := range c.exts() {
+                if e == ext {
+                    return c, nil
+                }
+            }
+        }
+        return nil, fmt.Errorf("no codec for %s files", ext)
+    }
+    if b != nil {
+        for _, c := range codecs {
+            if c.sniff(b) {
+                return c, nil
+            }
+        }
+    }
+    return nil, fmt.Errorf("unknown format, and no extension to tell it by")
+}
+
+// codec_named finds a codec by its name, or returns nil
+func codec_named(format string) codec {
+    for _, c := range codecs {
+        if c.name() == format {
+            return c
+        }
+    }
+    return nil
+}
+
+// layout_codec finds the codec a file is written with: by the extension of
+// name, or when it has none, by the format of its layout
+func layout_codec(name string, l layout) (codec, error) {
+    if path.Ext(name) == "" && codec_named(l.format) != nil {
+        return codec_named(l.format), nil
+    }
+    return codec_for(name, nil)
+}
+
+// new_layout is an empty layout in the given format
+func new_layout(format string, newline bool) layout {
+    return layout{format, []string{}, "  ", "", map[string]bool{}, map[string]comment{}, map[string]bool{}, map[string]style{}, map[string]anchor{}, comma_style{}, false, array_strategies{}, map[string]bool{}, newline, false}
+}
+
+type json_codec struct{}
+
+func (json_codec) name() string {
+    return "json"
+}
+
+// the json codec also reads jsonc and json5, and writes them back in the
+// same dialect
+func (json_codec) exts() []string {
+    return []string{".json", ".jsonc", ".json5"}
+}
+
+func (json_codec) sniff(b []byte) bool {
+    return bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) && json.Valid(b)
+}
+
+func (json_codec) decode(b []byte) (map[string]interface{}, error) {
+    if json.Valid(b) {
+        return decode_object(b)
+    }
+    p, err := parse_jsonc(b)
+    if err != nil {
+        return map[string]interface{}{}, err
+    }
+    return decode_object(p.out.Bytes())
+}
+
+func (json_codec) decode_error(path string, b []byte, err error) error {
+    if _, ok := err.(file_error); ok {
+        return place_error(path, err)
+    }
+    return decode_error(path, b, err)
+}
+
+func (json_codec) read_layout(b []byte) layout {
+    l := new_layout("json", false)
+    if json.Valid(b) {
+        json_layout(b, &l)
+        return l
+    }
+    p, err := parse_jsonc(b)
+    if err != nil {
+        return l
+    }
+    return p.layout(l)
+}
+
+func (json_codec) default_layout() layout {
+    return new_layout("json", false)
+}
+
+func (json_codec) encode(doc *doc_node, l layout) ([]byte, error) {
+    var sb strings.Builder
+    c := l.comments[""]
+    write_comment(&sb, c.head, "")
+    encode_json(&sb, doc, l, 0)
+    if c.foot != "" {
+        sb.WriteString("\n")
+        write_comment(&sb, c.foot, "")
+    }
+    return []byte(sb.String()), nil
+}
+
+// yaml_codec reads yaml, and json written in a yaml file
+type yaml_codec struct{}
+
+func (yaml_codec) name() string {
+    return "yaml"
+}
+
+func (yaml_codec) exts() []string {
+    return []string{".yaml", ".yml"}
+}
+
+func (yaml_codec) sniff(b []byte) bool {
+    var obj map[string]interface{}
+    return yaml.Unmarshal(b, &obj) == nil && len(obj) > 0
+}
+
+func (yaml_codec) decode(b []byte) (map[string]interface{}, error) {
+    if json.Valid(b) {
+        return decode_object(b)
+    }
+    return decode_yaml(b)
+}
+
+func (yaml_codec) decode_error(path string, b []byte, err error) error {
+    return decode_error(path, b, err)
+}
+
+func (yaml_codec) read_layout(b []byte) layout {
+    l := new_layout("yaml", true)
+    if json.Valid(b) {
+        json_layout(b, &l)
+        return l
+    }
+    var doc yaml.Node
+    err := yaml.Unmarshal(b, &doc)
+    if err != nil {
+        return l
+    }
+    l.known = true
+    l.newline = bytes.HasSuffix(b, []byte("\n"))
+    yaml_order(&doc, "", &l.order)
+    yaml_indent(&doc, "", &l)
+    yaml_comments(&doc, "", l.comments)
+    yaml_styles(&doc, "", strings.Split(string(b), "\n"), l.styles)
+    yaml_anchors(&doc, "", l.anchors)
+    return l
+}
+
+func (yaml_codec) default_layout() layout {
+    return new_layout("yaml", true)
+}
+
+func (yaml_codec) encode(doc *doc_node, l layout) ([]byte, error) {
+    return encode_yaml(doc, l), nil
+}
+
+// decode_object decodes a json document, keeping numbers as json.Number
+func decode_object(b []byte) (map[string]interface{}, error) {
+    obj := map[string]interface{}{}
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    err := dec.Decode(&obj)
+    return obj, err
+}
@@ -0,0 +1,49 @@
+package carver
+
+import (
+    "testing"
+)
+
+func TestCodecFor(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, string, string]{
+        "json": {"a/app.json", "", "json"},
+        "jsonc": {"tsconfig.jsonc", "", "json"},
+        "json5": {"app.json5", "", "json"},
+        "yaml": {"app.yaml", "", "yaml"},
+        "yml": {"app.yml", "", "yaml"},
+        "toml": {"app.toml", "", "toml"},
+        "dotenv": {"app.env", "", "dotenv"},
+        "dotfile_dotenv": {"config/.env", "", "dotenv"},
+        "properties": {"application.properties", "", "properties"},
+        "extension_over_content": {"app.yaml", "{\"a\": 1}", "yaml"},
+        "sniff_json": {"app", "{\"a\": 1}", "json"},
+        "sniff_yaml": {"app", "a: 1\n", "yaml"},
+        "sniff_toml": {"app", "a = 1\n", "toml"},
+        "unknown_extension": {"notes.md", "a: 1\n", "no codec for .md files"},
+        "unknown_content": {"app", "just text\n", "unknown format, and no extension to tell it by"},
+    }
+    f := func(name string, content string) string {
+        c, err := codec_for(name, []byte(content))
+        if err != nil {
+            return err.Error()
+        }
+        return c.name()
+    }
+    runTestsTwoArgsParallel[string, string, string](t, f, testCases)
+}
+
+func TestLayoutCodec(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, string, string]{
+        "extension": {"app.json", "yaml", "json"},
+        "format": {"app", "toml", "toml"},
+        "neither": {"app", "", "unknown format, and no extension to tell it by"},
+    }
+    f := func(name string, format string) string {
+        c, err := layout_codec(name, layout{format: format})
+        if err != nil {
+            return err.Error()
+        }
+        return c.name()
+    }
+    runTestsTwoArgsParallel[string, string, string](t, f, testCases)
+}
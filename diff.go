@@ -0,0 +1,172 @@
+package carver
+
+import (
+    "fmt"
+    "strings"
+)
+
+// an edit is one line of a diff: ' ' keeps the line, '-' removes it and '+'
+// adds it
+type edit struct {
+    op byte
+    line string
+}
+
+const diff_context = 3
+
+// split_lines splits b into lines that keep their newline, so that a missing
+// newline at the end of the file shows up as a change
+func split_lines(b []byte) []string {
+    lines := strings.SplitAfter(string(b), "\n")
+    if lines[len(lines)-1] == "" {
+        lines = lines[:len(lines)-1]
+    }
+    return lines
+}
+
+// diff_lines finds the shortest edit script from a to b with Myers' algorithm
+func diff_lines(a []string, b []string) []edit {
+    n := len(a)
+    m := len(b)
+    max := n + m
+    offset := max + 1
+    v := make([]int, 2*max+3)
+    trace := [][]int{}
+    for d := 0; d <= max; d++ {
+        trace = append(trace, append([]int{}, v...))
+        done := false
+        for k := -d; k <= d; k += 2 {
+            var x int
+            if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+                x = v[offset+k+1]
+            } else {
+                x = v[offset+k-1] + 1
+            }
+            y := x - k
+            for x < n && y < m && a[x] == b[y] {
+                x++
+                y++
+            }
+            v[offset+k] = x
+            if x >= n && y >= m {
+                done = true
+                break
+            }
+        }
+        if done {
+            break
+        }
+    }
+
+    edits := []edit{}
+    x := n
+    y := m
+    for d := len(trace) - 1; d >= 0; d-- {
+        v := trace[d]
+        k := x - y
+        var prev_k int
+        if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+            prev_k = k + 1
+        } else {
+            prev_k = k - 1
+        }
+        prev_x := v[offset+prev_k]
+        prev_y := prev_x - prev_k
+        for x > prev_x && y > prev_y {
+            edits = append(edits, edit{' ', a[x-1]})
+            x--
+            y--
+        }
+        if d > 0 {
+            if x == prev_x {
+                edits = append(edits, edit{'+', b[y-1]})
+            } else {
+                edits = append(edits, edit{'-', a[x-1]})
+            }
+        }
+        x = prev_x
+        y = prev_y
+    }
+    for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+        edits[i], edits[j] = edits[j], edits[i]
+    }
+    return edits
+}
+
+// unified_diff describes how to turn a into b, or returns "" if they're equal
+func unified_diff(a_name string, b_name string, a []byte, b []byte) string {
+    if string(a) == string(b) {
+        return ""
+    }
+    edits := diff_lines(split_lines(a), split_lines(b))
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "--- %s\n+++ %s\n", a_name, b_name)
+    i := 0
+    a_line := 0
+    b_line := 0
+    for i < len(edits) {
+        // skip ahead to the next change, keeping some context before it
+        start := i
+        for start < len(edits) && edits[start].op == ' ' {
+            start++
+        }
+        if start == len(edits) {
+            break
+        }
+        context := start - diff_context
+        if context < i {
+            context = i
+        }
+        for ; i < context; i++ {
+            a_line++
+            b_line++
+        }
+        // extend the hunk until the changes are far enough apart
+        end := start
+        for j := start; j < len(edits); j++ {
+            if edits[j].op != ' ' {
+                end = j + 1
+                continue
+            }
+            if j - end >= 2*diff_context {
+                break
+            }
+        }
+        end += diff_context
+        if end > len(edits) {
+            end = len(edits)
+        }
+        a_len := 0
+        b_len := 0
+        for _, e := range edits[i:end] {
+            if e.op != '+' {
+                a_len++
+            }
+            if e.op != '-' {
+                b_len++
+            }
+        }
+        fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunk_range(a_line, a_len), hunk_range(b_line, b_len))
+        for _, e := range edits[i:end] {
+            sb.WriteByte(e.op)
+            sb.WriteString(e.line)
+            if !strings.HasSuffix(e.line, "\n") {
+                sb.WriteString("\n\\ No newline at end of file\n")
+            }
+        }
+        a_line += a_len
+        b_line += b_len
+        i = end
+    }
+    return sb.String()
+}
+
+func hunk_range(line int, length int) string {
+    if length == 0 {
+        return fmt.Sprintf("%d,0", line)
+    }
+    if length == 1 {
+        return fmt.Sprintf("%d", line+1)
+    }
+    return fmt.Sprintf("%d,%d", line+1, length)
+}
@@ -0,0 +1,34 @@
+package carver
+
+import (
+    "testing"
+)
+
+func TestUnifiedDiff(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, string, string]{
+        "same": {
+            "a\nb\n",
+            "a\nb\n",
+            "",
+        },
+        "new_file": {
+            "",
+            "a\n",
+            "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n",
+        },
+        "change": {
+            "{\n  \"foo\": \"bar\"\n}",
+            "{\n  \"foo\": \"baz\"\n}",
+            "--- old\n+++ new\n@@ -1,3 +1,3 @@\n {\n-  \"foo\": \"bar\"\n+  \"foo\": \"baz\"\n }\n\\ No newline at end of file\n",
+        },
+        "hunks": {
+            "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+            "0\n2\n3\n4\n5\n6\n7\n8\n9\n11\n",
+            "--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+0\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+11\n",
+        },
+    }
+    f := func(a string, b string) string {
+        return unified_diff("old", "new", []byte(a), []byte(b))
+    }
+    runTestsTwoArgsParallel[string, string, string](t, f, testCases)
+}
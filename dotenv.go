@@ -0,0 +1,197 @@
+package carver
+
+import (
+    "fmt"
+    "strings"
+)
+
+// dotenv_codec reads and writes dotenv files, e.g. app.env: lines of
+// KEY=value, with optional quotes and export
+type dotenv_codec struct{}
+
+func (dotenv_codec) name() string {
+    return "dotenv"
+}
+
+func (dotenv_codec) exts() []string {
+    return []string{".env"}
+}
+
+// sniff never matches, since almost any text reads as dotenv
+func (dotenv_codec) sniff(b []byte) bool {
+    return false
+}
+
+func (dotenv_codec) decode(b []byte) (map[string]interface{}, error) {
+    f, err := parse_dotenv(b)
+    return f.object(), err
+}
+
+func (dotenv_codec) decode_error(path string, b []byte, err error) error {
+    return place_error(path, err)
+}
+
+func (dotenv_codec) read_layout(b []byte) layout {
+    f, err := parse_dotenv(b)
+    if err != nil {
+        return new_layout("dotenv", true)
+    }
+    return f.layout("dotenv")
+}
+
+func (dotenv_codec) default_layout() layout {
+    return new_layout("dotenv", true)
+}
+
+func (dotenv_codec) encode(doc *doc_node, l layout) ([]byte, error) {
+    return encode_flat(doc, l, dotenv_entry)
+}
+
+func parse_dotenv(b []byte) (flat_file, error) {
+    f := flat_file{}
+    lines, newline := flat_lines(b)
+    f.newline = newline
+    for i := 0; i < len(lines); i++ {
+        line_number := i + 1
+        line := lines[i]
+        text := strings.TrimLeft(line, " \t")
+        if text == "" || strings.HasPrefix(text, "#") {
+            f.add_line(line)
+            continue
+        }
+        lead := line[:len(line)-len(text)]
+        if strings.HasPrefix(text, "export ") {
+            rest := strings.TrimLeft(text[len("export "):], " \t")
+            lead += text[:len(text)-len(rest)]
+            text = rest
+        }
+        eq := strings.Index(text, "=")
+        if eq < 0 {
+            return f, file_error{"", line_number, 0, fmt.Errorf("expected KEY=value")}
+        }
+        key := strings.TrimRight(text[:eq], " \t")
+        if key == "" || strings.ContainsAny(key, " \t") {
+            return f, file_error{"", line_number, len(lead) + 1, fmt.Errorf("invalid key %q", key)}
+        }
+        rest := text[eq+1:]
+        value := strings.TrimLeft(rest, " \t")
+        e := flat_entry{key: key}
+        e.style = style{lead: lead, sep: text[len(key):eq+1] + rest[:len(rest)-len(value)]}
+        if value != "" && (value[0] == '"' || value[0] == '\'') {
+            quote := value[:1]
+            // a quoted value may go on over several lines
+            raw := value[1:]
+            end := dotenv_quote_end(raw, quote)
+            for end < 0 && i+1 < len(lines) {
+                i++
+                raw += "\n" + lines[i]
+                end = dotenv_quote_end(raw, quote)
+            }
+            if end < 0 {
+                return f, file_error{"", line_number, 0, fmt.Errorf("%s quote is never closed", quote)}
+            }
+            after := raw[end+1:]
+            raw = raw[:end]
+            if strings.TrimSpace(after) != "" && !strings.HasPrefix(strings.TrimLeft(after, " \t"), "#") {
+                return f, file_error{"", i + 1, 0, fmt.Errorf("unexpected %q after the closing quote", strings.TrimSpace(after))}
+            }
+            e.comment.line = after
+            e.style.quote = quote
+            e.style.raw = raw
+            e.value = raw
+            if quote == "\"" {
+                e.value = dotenv_unescape(raw)
+            }
+        } else {
+            // an unquoted value ends at a comment
+            comment := strings.Index(value, " #")
+            if strings.HasPrefix(value, "#") {
+                comment = 0
+            }
+            if comment >= 0 {
+                e.comment.line = value[comment:]
+                value = value[:comment]
+            }
+            trimmed := strings.TrimRight(value, " \t")
+            e.comment.line = value[len(trimmed):] + e.comment.line
+            e.style.raw = trimmed
+            e.value = trimmed
+        }
+        e.style.value = e.value
+        f.add_entry(e)
+    }
+    f.finish()
+    return f, nil
+}
+
+// dotenv_quote_end finds the quote that closes a value, or returns -1
+func dotenv_quote_end(s string, quote string) int {
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && quote == "\"" {
+            i++
+            continue
+        }
+        if s[i] == quote[0] {
+            return i
+        }
+    }
+    return -1
+}
+
+func dotenv_unescape(s string) string {
+    var sb strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] != '\\' || i+1 == len(s) {
+            sb.WriteByte(s[i])
+            continue
+        }
+        i++
+        switch s[i] {
+        case 'n':
+            sb.WriteByte('\n')
+        case 'r':
+            sb.WriteByte('\r')
+        case 't':
+            sb.WriteByte('\t')
+        case '"', '\\':
+            sb.WriteByte(s[i])
+        default:
+            sb.WriteByte('\\')
+            sb.WriteByte(s[i])
+        }
+    }
+    return sb.String()
+}
+
+func dotenv_escape(s string) string {
+    s = strings.ReplaceAll(s, "\\", "\\\\")
+    s = strings.ReplaceAll(s, "\"", "\\\"")
+    s = strings.ReplaceAll(s, "\n", "\\n")
+    return strings.ReplaceAll(s, "\r", "\\r")
+}
+
+// dotenv_bare reports whether a value can be written without quotes
+func dotenv_bare(s string) bool {
+    return s == strings.TrimSpace(s) && !strings.ContainsAny(s, "#\"'\\\n\r")
+}
+
+// dotenv_entry writes the line of a key. a value that hasn't changed is
+// written as it was, and a changed one keeps its quotes where it can.
+func dotenv_entry(key string, value string, s style, ok bool) string {
+    if !ok {
+        s = style{sep: "="}
+    } else if s.value == value {
+        return s.lead + key + s.sep + s.quote + s.raw + s.quote
+    }
+    quote := s.quote
+    switch {
+    case quote == "" && !dotenv_bare(value):
+        quote = "\""
+    case quote == "'" && strings.ContainsAny(value, "'\r"):
+        quote = "\""
+    }
+    if quote == "\"" {
+        value = dotenv_escape(value)
+    }
+    return s.lead + key + s.sep + quote + value + quote
+}
@@ -0,0 +1,93 @@
+package carver
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestDotenvRoundTrip(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "plain": {
+            "A=1\nB=two\nlog.level=info\n",
+            "A=1\nB=two\nlog.level=info\n",
+        },
+        "quotes_and_export": {
+            "export A=1\nB='s3cr#t'\nC=\"a\\nb\"\nD = spaced\n",
+            "export A=1\nB='s3cr#t'\nC=\"a\\nb\"\nD = spaced\n",
+        },
+        "comments": {
+            "# file\n\n# about a\nA=1   # inline\n\nB=2\n# end\n",
+            "# file\n\n# about a\nA=1   # inline\n\nB=2\n# end\n",
+        },
+        "multi_line": {
+            "A=\"one\ntwo\" # after\nB=3",
+            "A=\"one\ntwo\" # after\nB=3",
+        },
+    }
+    f := func(in string) string {
+        obj, err := dotenv_codec{}.decode([]byte(in))
+        if err != nil {
+            return err.Error()
+        }
+        flattened, _ := flatten(obj, nil)
+        b, err := encode_file(flattened, dotenv_codec{}.read_layout([]byte(in)), dotenv_codec{})
+        if err != nil {
+            return err.Error()
+        }
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestDotenvDecode(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "values": {
+            "A=1\nexport B='x # y'\nC=\"a\\\"b\\n\"\nD=z # c\nE=",
+            `{"A":"1","B":"x # y","C":"a\"b\n","D":"z","E":""}`,
+        },
+        "dots_stay_flat": {
+            "a.b.c=1\na.b=2",
+            `{"a.b":"2","a.b.c":"1"}`,
+        },
+        "later_line_wins": {
+            "A=1\nA=2",
+            `{"A":"2"}`,
+        },
+        "no_equals": {
+            "A=1\nB\n",
+            ":2: expected KEY=value",
+        },
+        "unclosed_quote": {
+            "A=\"1\nB=2\n",
+            ":1: \" quote is never closed",
+        },
+        "text_after_quote": {
+            "A='1' 2\n",
+            ":1: unexpected \"2\" after the closing quote",
+        },
+    }
+    f := func(in string) string {
+        obj, err := dotenv_codec{}.decode([]byte(in))
+        if err != nil {
+            return dotenv_codec{}.decode_error("", []byte(in), err).Error()
+        }
+        b, _ := json.Marshal(obj)
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestDotenvEntry(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, style, string]{
+        "new_bare": {"x", style{}, "K=x"},
+        "new_spaces": {"a b ", style{}, "K=\"a b \""},
+        "unchanged": {"a\nb", style{"export ", "=", "\"", "a\\nb", "a\nb"}, "export K=\"a\\nb\""},
+        "changed_single": {"new", style{"", "=", "'", "old", "old"}, "K='new'"},
+        "changed_single_quote": {"it's", style{"", "=", "'", "old", "old"}, "K=\"it's\""},
+        "changed_bare_needs_quotes": {"a#b", style{"", "=", "", "old", "old"}, "K=\"a#b\""},
+    }
+    f := func(value string, s style) string {
+        return dotenv_entry("K", value, s, s.sep != "")
+    }
+    runTestsTwoArgsParallel[string, style, string](t, f, testCases)
+}
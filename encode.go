@@ -0,0 +1,531 @@
+package carver
+
+import (
+    "bytes"
+    "sort"
+    "strconv"
+    "strings"
+    "encoding/json"
+    "gopkg.in/yaml.v3"
+)
+
+// a doc_node is one key of a document rebuilt from a flat object, with its
+// children in the order they were added
+type doc_node struct {
+    key string
+    path string
+    value interface{}
+    children []*doc_node
+    index map[string]*doc_node
+    leaf bool
+    array bool
+}
+
+func new_doc_node(key string, p string) *doc_node {
+    return &doc_node{key, p, nil, []*doc_node{}, map[string]*doc_node{}, false, false}
+}
+
+func (n *doc_node) child(key string) *doc_node {
+    c, ok := n.index[key]
+    if !ok {
+        c = new_doc_node(key, join_path(n.path, key))
+        n.index[key] = c
+        n.children = append(n.children, c)
+    }
+    return c
+}
+
+// build_doc unflattens obj, adding keys in the given order
+func build_doc(obj map[string]interface{}, keys []string, l layout) *doc_node {
+    root := new_doc_node("", "")
+    for _, k := range keys {
+        n := root
+        for _, part := range split_path(k) {
+            n = n.child(part)
+        }
+        n.leaf = len(n.children) == 0
+        n.value = obj[k]
+    }
+    root.mark_arrays(l)
+    return root
+}
+
+// mark_arrays turns the objects keyed 0 to n-1 that were index arrays back
+// into arrays, along with the set and keyed arrays, whose items keep their
+// order. an object whose keys only look like indexes stays an object.
+func (n *doc_node) mark_arrays(l layout) {
+    if n.leaf {
+        return
+    }
+    for _, c := range n.children {
+        c.mark_arrays(l)
+    }
+    s := l.arrays.get(n.path)
+    if s.kind == "set" || s.kind == "keyed" {
+        n.array = len(n.children) > 0
+        if s.kind == "set" {
+            n.mark_set_tombstones()
+        }
+        return
+    }
+    indices := map[int]bool{}
+    for _, c := range n.children {
+        i, err := strconv.Atoi(c.key)
+        if err == nil && i >= 0 && i < len(n.children) && strconv.Itoa(i) == c.key {
+            indices[i] = true
+        }
+    }
+    if !l.index_arrays[n.path] || len(n.children) == 0 || len(indices) != len(n.children) {
+        return
+    }
+    n.array = true
+    sort.SliceStable(n.children, func(i, j int) bool {
+        a, _ := strconv.Atoi(n.children[i].key)
+        b, _ := strconv.Atoi(n.children[j].key)
+        return a < b
+    })
+}
+
+// mark_set_tombstones writes the set items a file removes as
+// {"$delete": item}
+func (n *doc_node) mark_set_tombstones() {
+    for _, c := range n.children {
+        if c.leaf && c.value == tombstone {
+            c.value = map[string]interface{}{tombstone: c.key}
+        }
+    }
+}
+
+// value_doc turns a decoded value into a doc_node, with object keys sorted
+func value_doc(key string, p string, v interface{}) *doc_node {
+    n := new_doc_node(key, p)
+    switch vv := v.(type) {
+    case map[string]interface{}:
+        if len(vv) == 0 {
+            n.leaf = true
+            n.value = vv
+            return n
+        }
+        keys := []string{}
+        for k := range vv {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            c := value_doc(k, join_path(p, k), vv[k])
+            n.index[k] = c
+            n.children = append(n.children, c)
+        }
+    case []interface{}:
+        if len(vv) == 0 {
+            n.leaf = true
+            n.value = vv
+            return n
+        }
+        n.array = true
+        for i, item := range vv {
+            key := strconv.Itoa(i)
+            n.children = append(n.children, value_doc(key, join_path(p, key), item))
+        }
+    default:
+        n.leaf = true
+        n.value = v
+    }
+    return n
+}
+
+// expand replaces leaves holding objects or arrays with doc_nodes, so the
+// encoders only ever see scalars and empty containers in leaves
+func (n *doc_node) expand() *doc_node {
+    if n.leaf {
+        switch n.value.(type) {
+        case nil, bool, string, float64, json.Number, datetime:
+            return n
+        }
+        b, _ := json.Marshal(n.value)
+        v, _ := decode_value(b)
+        return value_doc(n.key, n.path, v)
+    }
+    for i, c := range n.children {
+        n.children[i] = c.expand()
+        n.index[c.key] = n.children[i]
+    }
+    return n
+}
+
+// decoded rebuilds the value a node holds
+func (n *doc_node) decoded() interface{} {
+    if n.leaf {
+        return n.value
+    }
+    if n.array {
+        items := []interface{}{}
+        for _, c := range n.children {
+            items = append(items, c.decoded())
+        }
+        return items
+    }
+    obj := map[string]interface{}{}
+    for _, c := range n.children {
+        obj[c.key] = c.decoded()
+    }
+    return obj
+}
+
+// same_value reports whether two nodes hold equal values
+func same_value(a *doc_node, b *doc_node) bool {
+    return json_scalar(a.decoded()) == json_scalar(b.decoded())
+}
+
+func (n *doc_node) is_empty() bool {
+    return !n.leaf && len(n.children) == 0
+}
+
+// encode_file renders a flat object with a codec and the given layout
+func encode_file(obj map[string]interface{}, l layout, c codec) ([]byte, error) {
+    doc := build_doc(obj, order_keys(obj, l.order), l).expand()
+    b, err := c.encode(doc, l)
+    if err != nil {
+        return nil, err
+    }
+    b = bytes.TrimRight(b, "\n")
+    if l.newline {
+        b = append(b, '\n')
+    }
+    return b, nil
+}
+
+func json_scalar(v interface{}) string {
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    enc.SetEscapeHTML(false)
+    enc.Encode(v)
+    return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// encode_json writes a node as json. jsonc and json5 files also get their
+// comments, trailing commas, unquoted keys and scalars as they were written.
+func encode_json(sb *strings.Builder, n *doc_node, l layout, depth int) {
+    if n.leaf {
+        sb.WriteString(json_value(n, l))
+        return
+    }
+    open, close := "{", "}"
+    if n.array {
+        open, close = "[", "]"
+    }
+    sb.WriteString(open)
+    if len(n.children) == 0 {
+        sb.WriteString(close)
+        return
+    }
+    multiline := json_multiline(n, l)
+    if multiline && l.comments[n.path].line != "" {
+        sb.WriteString(" " + l.comments[n.path].line)
+    }
+    ind := strings.Repeat(l.indent, depth+1)
+    for i, c := range n.children {
+        cm := l.comments[c.path]
+        if multiline {
+            json_comment(sb, cm.head, ind)
+            sb.WriteString("\n" + ind)
+        } else if l.indent != "" && i > 0 {
+            sb.WriteString(" ")
+        }
+        if !n.array {
+            sb.WriteString(json_key(c, l))
+            sb.WriteString(":")
+            if l.indent != "" {
+                sb.WriteString(" ")
+            }
+        }
+        encode_json(sb, c, l, depth+1)
+        if i < len(n.children) - 1 || l.trailing_commas.get(n.array, multiline) {
+            sb.WriteString(",")
+        }
+        if multiline {
+            // a multiline child writes its line comment after it opens
+            if cm.line != "" && !json_multiline(c, l) {
+                sb.WriteString(" " + cm.line)
+            }
+            json_comment(sb, cm.foot, ind)
+        }
+    }
+    if multiline {
+        sb.WriteString("\n" + strings.Repeat(l.indent, depth))
+    }
+    sb.WriteString(close)
+}
+
+// json_multiline reports whether a node is written over several lines
+func json_multiline(n *doc_node, l layout) bool {
+    return !n.leaf && len(n.children) > 0 && l.indent != "" && !l.inline[n.path]
+}
+
+// json_comment writes each line of a comment on a line of its own
+func json_comment(sb *strings.Builder, text string, ind string) {
+    if text == "" {
+        return
+    }
+    for _, line := range strings.Split(text, "\n") {
+        sb.WriteString("\n")
+        if line != "" {
+            sb.WriteString(ind + line)
+        }
+    }
+}
+
+// json_key writes the key of a node, unquoted or in single quotes when the
+// file wrote it that way
+func json_key(n *doc_node, l layout) string {
+    if l.bare_keys && jsonc_ident.MatchString(n.key) {
+        return n.key
+    }
+    if l.styles[n.path].quote == "'" {
+        return json5_single_quote(n.key)
+    }
+    return json_scalar(n.key)
+}
+
+func json5_single_quote(s string) string {
+    s = json_scalar(s)
+    s = strings.ReplaceAll(s[1:len(s)-1], "\\\"", "\"")
+    return "'" + strings.ReplaceAll(s, "'", "\\'") + "'"
+}
+
+// json_value writes a scalar, as it was written while its value doesn't
+// change
+func json_value(n *doc_node, l layout) string {
+    s := json_scalar(n.value)
+    st, ok := l.styles[n.path]
+    if ok && st.value == s {
+        return st.raw
+    }
+    return s
+}
+
+// yaml_scalar renders a scalar, or an empty object or array, in flow style.
+// block scalars keep their lines and get indented below ind.
+func yaml_scalar(v interface{}, ind string) string {
+    switch vv := v.(type) {
+    case map[string]interface{}:
+        return "{}"
+    case []interface{}:
+        return "[]"
+    case json.Number:
+        return vv.String()
+    }
+    var buf bytes.Buffer
+    enc := yaml.NewEncoder(&buf)
+    enc.SetIndent(2)
+    enc.Encode(v)
+    enc.Close()
+    lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+    for i := 1; i < len(lines); i++ {
+        if lines[i] != "" {
+            lines[i] = ind + lines[i]
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+// yaml_key writes a key plainly when yaml reads it back as the same string,
+// which keeps keys like y and on that yaml 1.1 read as booleans unquoted
+func yaml_key(key string) string {
+    for _, s := range []string{key, yaml_scalar(key, "")} {
+        var doc yaml.Node
+        err := yaml.Unmarshal([]byte(s + ": 0"), &doc)
+        if err != nil || len(doc.Content) == 0 || len(doc.Content[0].Content) != 2 {
+            continue
+        }
+        k := doc.Content[0].Content[0]
+        if k.ShortTag() == "!!str" && k.Value == key {
+            return s
+        }
+    }
+    return json_scalar(key)
+}
+
+func encode_yaml(doc *doc_node, l layout) []byte {
+    var sb strings.Builder
+    c := l.comments[""]
+    if c.head != "" {
+        write_comment(&sb, c.head, "")
+        sb.WriteString("\n")
+    }
+    if doc.leaf || doc.is_empty() {
+        sb.WriteString(yaml_scalar(map[string]interface{}{}, "") + "\n")
+    } else {
+        encode_yaml_node(&sb, doc, "", l, false, map[string]*doc_node{})
+    }
+    write_comment(&sb, c.foot, "")
+    return []byte(sb.String())
+}
+
+// write_comment writes each line of a comment at indentation ind
+func write_comment(sb *strings.Builder, text string, ind string) {
+    if text == "" {
+        return
+    }
+    for _, line := range strings.Split(text, "\n") {
+        if line != "" {
+            sb.WriteString(ind + line)
+        }
+        sb.WriteString("\n")
+    }
+}
+
+// line_comment is the comment written after a value on the same line.
+// values spanning several lines don't get one.
+func line_comment(value string, text string) string {
+    if text == "" || strings.Contains(value, "\n") {
+        return value
+    }
+    return value + " " + text
+}
+
+// encode_yaml_node writes the children of an object or array at indentation
+// ind. when inline is set the first child continues the current line, e.g.
+// right after the dash of a sequence item. anchors holds the nodes written so
+// far under each yaml anchor, which later aliases and merge keys refer to.
+func encode_yaml_node(sb *strings.Builder, n *doc_node, ind string, l layout, inline bool, anchors map[string]*doc_node) {
+    merge, merged := yaml_merge(n, l, anchors)
+    if merge != "" {
+        if !inline {
+            sb.WriteString(ind)
+        }
+        sb.WriteString("<<: " + merge + "\n")
+        inline = false
+    }
+    for _, c := range n.children {
+        if merged[c.key] {
+            continue
+        }
+        cm := l.comments[c.path]
+        if !inline {
+            write_comment(sb, cm.head, ind)
+            sb.WriteString(ind)
+        }
+        inline = false
+        if n.array {
+            item_ind := ind + "  "
+            text, block := yaml_head(c, item_ind, l, anchors)
+            if block && text == "" {
+                sb.WriteString("- ")
+                encode_yaml_node(sb, c, item_ind, l, true, anchors)
+            } else {
+                sb.WriteString("- " + line_comment(text, cm.line) + "\n")
+                if block {
+                    encode_yaml_node(sb, c, item_ind, l, false, anchors)
+                }
+            }
+            write_comment(sb, cm.foot, ind)
+            continue
+        }
+        text, block := yaml_head(c, ind, l, anchors)
+        sb.WriteString(yaml_key(c.key) + ":")
+        if text != "" {
+            sb.WriteString(" ")
+        }
+        sb.WriteString(line_comment(text, cm.line) + "\n")
+        if block && c.array {
+            encode_yaml_node(sb, c, ind + l.seq_indent, l, false, anchors)
+        } else if block {
+            encode_yaml_node(sb, c, ind + l.indent, l, false, anchors)
+        }
+        write_comment(sb, cm.foot, ind)
+    }
+}
+
+// yaml_head is what a node writes on the line of its key or dash: an alias,
+// or its anchor and its value unless the value is a block below it
+func yaml_head(n *doc_node, ind string, l layout, anchors map[string]*doc_node) (string, bool) {
+    a := l.anchors[n.path]
+    if target, ok := anchors[a.alias]; a.alias != "" && ok && same_value(target, n) {
+        return "*" + a.alias, false
+    }
+    text := ""
+    block := false
+    switch {
+    case n.leaf || n.is_empty():
+        text = yaml_leaf(n, l, ind)
+    case l.inline[n.path]:
+        text = yaml_flow(n, l)
+    default:
+        block = true
+    }
+    if a.name != "" {
+        anchors[a.name] = n
+        text = strings.TrimSuffix("&" + a.name + " " + text, " ")
+    }
+    return text, block
+}
+
+// yaml_merge is the << of a mapping whose merged anchors were written, and
+// the keys it gives their values, which aren't written again. a mapping that
+// drops a merged key is written out in full.
+func yaml_merge(n *doc_node, l layout, anchors map[string]*doc_node) (string, map[string]bool) {
+    names := l.anchors[n.path].merges
+    if n.array || len(names) == 0 {
+        return "", nil
+    }
+    aliases := []string{}
+    merged := map[string]*doc_node{}
+    for _, name := range names {
+        target, ok := anchors[name]
+        if !ok || target.leaf || target.array {
+            return "", nil
+        }
+        for _, c := range target.children {
+            if _, ok := merged[c.key]; !ok {
+                merged[c.key] = c
+            }
+        }
+        aliases = append(aliases, "*" + name)
+    }
+    same := map[string]bool{}
+    for key, m := range merged {
+        c, ok := n.index[key]
+        if !ok {
+            return "", nil
+        }
+        same[key] = same_value(c, m)
+    }
+    if len(aliases) == 1 {
+        return aliases[0], same
+    }
+    return "[" + strings.Join(aliases, ", ") + "]", same
+}
+
+// yaml_leaf writes a scalar, as it was written while its value doesn't
+// change
+func yaml_leaf(n *doc_node, l layout, ind string) string {
+    st, ok := l.styles[n.path]
+    if ok && st.value == json_scalar(n.value) {
+        return st.raw
+    }
+    return yaml_scalar(n.value, ind)
+}
+
+// yaml_flow writes an object or array on one line, e.g. [a, b]
+func yaml_flow(n *doc_node, l layout) string {
+    if n.leaf {
+        s := yaml_leaf(n, l, "")
+        if strings.ContainsAny(s, ",[]{}\n") {
+            return json_scalar(n.value)
+        }
+        return s
+    }
+    items := []string{}
+    for _, c := range n.children {
+        item := yaml_flow(c, l)
+        if !n.array {
+            item = yaml_key(c.key) + ": " + item
+        }
+        items = append(items, item)
+    }
+    if n.array {
+        return "[" + strings.Join(items, ", ") + "]"
+    }
+    return "{" + strings.Join(items, ", ") + "}"
+}
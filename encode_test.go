@@ -0,0 +1,86 @@
+package carver
+
+import (
+    "testing"
+)
+
+func TestEncodeFileRoundTrip(t * testing.T) {
+    testCases := map[string]testCaseOneArg[[]string, string]{
+        "json_order": {
+            []string{"a.json", "{\n  \"zeta\": 1,\n  \"alpha\": {\n    \"b\": true,\n    \"a\": null\n  }\n}"},
+            "{\n  \"zeta\": 1,\n  \"alpha\": {\n    \"b\": true,\n    \"a\": null\n  }\n}",
+        },
+        "json_indent_newline_inline": {
+            []string{"a.json", "{\n    \"list\": [1, 2, 3],\n    \"html\": \"<b>\",\n    \"nested\": [\n        {\"k\": \"v\"}\n    ]\n}\n"},
+            "{\n    \"list\": [1, 2, 3],\n    \"html\": \"<b>\",\n    \"nested\": [\n        {\"k\": \"v\"}\n    ]\n}\n",
+        },
+        "json_compact": {
+            []string{"a.json", "{\"b\":1,\"a\":[true,false]}"},
+            "{\"b\":1,\"a\":[true,false]}",
+        },
+        "json_single_line": {
+            []string{"a.json", "{\"b\": 1, \"a\": [true, false]}"},
+            "{\"b\": 1, \"a\": [true, false]}",
+        },
+        "json_types": {
+            []string{"a.json", "{\n  \"id\": 9007199254740993,\n  \"ratio\": 1.0,\n  \"big\": 1e400,\n  \"nothing\": null,\n  \"obj\": {},\n  \"arr\": []\n}"},
+            "{\n  \"id\": 9007199254740993,\n  \"ratio\": 1.0,\n  \"big\": 1e400,\n  \"nothing\": null,\n  \"obj\": {},\n  \"arr\": []\n}",
+        },
+        "json_escaped_keys": {
+            []string{"a.json", "{\n  \"log.level\": \"info\",\n  \"a/b\": {\n    \"~c\": 1,\n    \"example.com\": true\n  }\n}"},
+            "{\n  \"log.level\": \"info\",\n  \"a/b\": {\n    \"~c\": 1,\n    \"example.com\": true\n  }\n}",
+        },
+        "yaml_indent": {
+            []string{"a.yaml", "zeta: 1\nspec:\n    replicas: 2\n    args:\n      - --verbose\n      - name: x\n        value: z\nalpha: true\n"},
+            "zeta: 1\nspec:\n    replicas: 2\n    args:\n      - --verbose\n      - name: x\n        value: z\nalpha: true\n",
+        },
+        "yaml_flow_block_scalar": {
+            []string{"a.yaml", "list: [a, b]\nscript: |\n  echo hi\n  echo bye\nempty: {}\n"},
+            "list: [a, b]\nscript: |\n  echo hi\n  echo bye\nempty: {}\n",
+        },
+        "json_numeric_keys": {
+            []string{"a.json", "{\n  \"m\": {\n    \"0\": \"a\",\n    \"1\": \"b\"\n  },\n  \"l\": [\n    \"a\",\n    \"b\"\n  ]\n}\n"},
+            "{\n  \"m\": {\n    \"0\": \"a\",\n    \"1\": \"b\"\n  },\n  \"l\": [\n    \"a\",\n    \"b\"\n  ]\n}\n",
+        },
+        "yaml_comments": {
+            []string{"a.yaml", "# about the file\n\n# how many pods\nreplicas: 1 # small\nspec: # the spec\n  # args\n  args:\n    # first\n    - a\n    - b # second\n  # end of spec\n"},
+            "# about the file\n\n# how many pods\nreplicas: 1 # small\nspec: # the spec\n  # args\n  args:\n    # first\n    - a\n    - b # second\n  # end of spec\n",
+        },
+    }
+    f := func(in []string) string {
+        c, _ := codec_for(in[0], nil)
+        obj, _ := c.decode([]byte(in[1]))
+        flattened, _ := flatten(obj, nil)
+        b, _ := encode_file(flattened, c.read_layout([]byte(in[1])).rekey(obj, nil), c)
+        return string(b)
+    }
+    runTestsOneArgParallel[[]string, string](t, f, testCases)
+}
+
+func TestMergeOrders(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[[]string, []string, []string]{
+        "append": {
+            []string{"a", "b"},
+            []string{"a", "b", "c"},
+            []string{"a", "b", "c"},
+        },
+        "after_known_key": {
+            []string{"a", "b"},
+            []string{"a", "x", "b"},
+            []string{"a", "x", "b"},
+        },
+        "first": {
+            []string{"a", "b"},
+            []string{"x", "b"},
+            []string{"x", "a", "b"},
+        },
+        "keeps_earlier_order": {
+            []string{"b", "a"},
+            []string{"a", "b", "c"},
+            []string{"b", "c", "a"},
+        },
+    }
+    runTestsTwoArgsParallel[[]string, []string, []string](t, func(a []string, b []string) []string {
+        return merge_orders(a, b)
+    }, testCases)
+}
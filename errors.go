@@ -0,0 +1,115 @@
+package carver
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// a file_error is an error in one file, with the line and column it was
+// found at when they are known
+type file_error struct {
+    path string
+    line int
+    col int
+    err error
+}
+
+func (e file_error) Error() string {
+    switch {
+    case e.line > 0 && e.col > 0:
+        return fmt.Sprintf("%s:%d:%d: %s", e.path, e.line, e.col, e.err)
+    case e.line > 0:
+        return fmt.Sprintf("%s:%d: %s", e.path, e.line, e.err)
+    }
+    return fmt.Sprintf("%s: %s", e.path, e.err)
+}
+
+func (e file_error) Unwrap() error {
+    return e.err
+}
+
+// an error_list collects the errors of a whole run, so they can be reported
+// together
+type error_list []error
+
+func (errs error_list) Error() string {
+    lines := []string{}
+    for _, err := range errs {
+        lines = append(lines, err.Error())
+    }
+    return strings.Join(lines, "\n")
+}
+
+// add appends err, flattening other error lists into this one
+func (errs error_list) add(err error) error_list {
+    switch e := err.(type) {
+    case nil:
+        return errs
+    case error_list:
+        return append(errs, e...)
+    }
+    return append(errs, err)
+}
+
+// err returns the list as an error, or nil when it's empty
+func (errs error_list) err() error {
+    if len(errs) == 0 {
+        return nil
+    }
+    return errs
+}
+
+// errors_of lists the errors an error holds
+func errors_of(err error) []error {
+    switch e := err.(type) {
+    case nil:
+        return []error{}
+    case error_list:
+        return e
+    }
+    return []error{err}
+}
+
+// place_error puts an error that a parser found on a line, without knowing
+// the file, in the file at path
+func place_error(path string, err error) error {
+    fe, ok := err.(file_error)
+    if !ok {
+        return file_error{path, 0, 0, err}
+    }
+    fe.path = path
+    return fe
+}
+
+var yaml_line = regexp.MustCompile(`^(?:.*: )?yaml: line (\d+): (.*)$`)
+
+// decode_error places a decoding error of the file at path on a line, and a
+// column when the decoder gives an offset
+func decode_error(path string, b []byte, err error) error {
+    offset := int64(-1)
+    switch e := err.(type) {
+    case *json.SyntaxError:
+        offset = e.Offset
+    case *json.UnmarshalTypeError:
+        offset = e.Offset
+    }
+    if offset >= 0 {
+        if offset > int64(len(b)) {
+            offset = int64(len(b))
+        }
+        before := b[:offset]
+        line := bytes.Count(before, []byte("\n")) + 1
+        col := len(before) - bytes.LastIndexByte(before, '\n')
+        return file_error{path, line, col, err}
+    }
+    m := yaml_line.FindStringSubmatch(err.Error())
+    if m != nil {
+        line, _ := strconv.Atoi(m[1])
+        return file_error{path, line, 0, fmt.Errorf("%s", m[2])}
+    }
+    return file_error{path, 0, 0, err}
+}
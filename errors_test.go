@@ -0,0 +1,126 @@
+package carver
+
+import (
+    "context"
+    "errors"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+    "testing/fstest"
+)
+
+func TestNewFileErrors(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, string, string]{
+        "json": {
+            "bad.json",
+            "{\n  \"x\": 1,\n  \"y\" 2\n}",
+            "bad.json:3:7: invalid character '2' after object key",
+        },
+        "yaml": {
+            "bad.yaml",
+            "a: 1\n b: 2\n",
+            "bad.yaml:2: mapping values are not allowed in this context",
+        },
+        "toml": {
+            "bad.toml",
+            "a = 1\nb = = 2\n",
+            "bad.toml:2:5: expected value but found '=' instead",
+        },
+    }
+    dir := t.TempDir()
+    f := func(name string, content string) string {
+        os.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+        _, err := new_file(os_root(dir), name, nil)
+        rel, _ := filepath.Rel(dir, err.(file_error).path)
+        return rel + err.Error()[len(err.(file_error).path):]
+    }
+    runTestsTwoArgsParallel[string, string, string](t, f, testCases)
+}
+
+// a config file can't hold a tombstone, which merge would take for a
+// deletion and drop
+func TestSourceTombstones(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, string, []string]{
+        "value": {
+            "dirs:\n - dev\n - prod\n",
+            `{"cmd": "$delete", "e": "dev"}`,
+            []string{`dev/x.json: /cmd: "$delete" is reserved for the keys and set items carver deletes`},
+        },
+        "value_with_tombstones": {
+            "dirs:\n - dev\n - prod\n\ntombstones: true\n",
+            `{"cmd": "$delete", "e": "dev"}`,
+            []string{`dev/x.json: /cmd: "$delete" is reserved for the keys and set items carver deletes`},
+        },
+        "set_item": {
+            "dirs:\n - dev\n - prod\n\narrays:\n  args: set\n",
+            `{"args": ["-v", {"$delete": "-q"}]}`,
+            []string{`dev/x.json: /args/-q: "$delete" is reserved for the keys and set items carver deletes`},
+        },
+        "array_item": {
+            "dirs:\n - dev\n - prod\n",
+            `{"list": ["a", "$delete"]}`,
+            []string{`dev/x.json: /list/1: "$delete" is reserved for the keys and set items carver deletes`},
+        },
+        "other_strings": {
+            "dirs:\n - dev\n - prod\n",
+            `{"cmd": "$deleted", "note": "a $delete"}`,
+            nil,
+        },
+    }
+    f := func(config string, dev string) []string {
+        fsys := fstest.MapFS{
+            ".carver.yaml": {Data: []byte(config)},
+            "dev/x.json": {Data: []byte(dev)},
+            "prod/x.json": {Data: []byte(`{"e": "prod"}`)},
+        }
+        tree, err := LoadTreeFS(fsys, ".")
+        if err == nil {
+            _, err = Normalize(context.Background(), tree, Options{Output: NewMemorySink()})
+        }
+        var errs error_list
+        if errors.As(err, &errs) {
+            messages := []string{}
+            for _, e := range errs {
+                messages = append(messages, e.Error())
+            }
+            return messages
+        }
+        if err != nil {
+            return []string{err.Error()}
+        }
+        return nil
+    }
+    runTestsTwoArgsParallel[string, string, []string](t, f, testCases)
+}
+
+func TestNormalizeKeepGoing(t * testing.T) {
+    dir := t.TempDir()
+    files := map[string]string{
+        "a/ok.json": `{"x": 1}`,
+        "b/ok.json": `{"x": 2}`,
+        "a/bad.json": `{"x": }`,
+        "b/bad.json": `{"x": 1}`,
+    }
+    for name, content := range files {
+        os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0750)
+        os.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+    }
+    config := opts{Dirs: []string{"a", "b"}}
+
+    filenames, _, _, _, err := normalize_dir(context.Background(), config, policy{}, os_root(dir), false, 0)
+    if len(errors_of(err)) != 1 || len(filenames) != 0 {
+        t.Fatalf(`expected one error and no files, got %v and %v`, err, filenames)
+    }
+
+    filenames, _, _, _, err = normalize_dir(context.Background(), config, policy{}, os_root(dir), true, 0)
+    names := []string{}
+    for name := range filenames {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    if len(errors_of(err)) != 1 || !reflect.DeepEqual(names, []string{"a/ok.json", "b/ok.json"}) {
+        t.Fatalf(`expected one error and the ok files, got %v and %v`, err, names)
+    }
+}
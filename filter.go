@@ -0,0 +1,131 @@
+package carver
+
+import (
+    "fmt"
+    "path"
+    "strings"
+)
+
+// a file_filter picks the config files of a dir by glob patterns. a file is
+// read when it matches an include, or there are none, and no exclude.
+type file_filter struct {
+    Include []string `json:"include"`
+    Exclude []string `json:"exclude"`
+}
+
+// file_filters holds the filter of every dir and the one of each env dir,
+// which a file has to pass as well
+type file_filters struct {
+    global file_filter
+    dirs map[string]file_filter
+}
+
+// new_file_filters checks the patterns of the "include", "exclude" and
+// "filters" config
+func new_file_filters(global file_filter, dirs map[string]file_filter, envs []string) (file_filters, error) {
+    filters := file_filters{global, map[string]file_filter{}}
+    known := map[string]bool{}
+    for _, env := range envs {
+        known[env] = true
+    }
+    err := global.check()
+    if err != nil {
+        return filters, err
+    }
+    for name, f := range dirs {
+        name = path.Clean(name)
+        if !known[name] {
+            return filters, fmt.Errorf("filters for %s, which isn't an env dir", name)
+        }
+        err := f.check()
+        if err != nil {
+            return filters, fmt.Errorf("filters for %s: %s", name, err)
+        }
+        filters.dirs[name] = f
+    }
+    return filters, nil
+}
+
+func (f file_filter) check() error {
+    for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+        _, err := path.Match(pattern, "")
+        if err != nil || pattern == "" {
+            return fmt.Errorf("invalid pattern %q", pattern)
+        }
+    }
+    return nil
+}
+
+func (f file_filter) match(name string) bool {
+    included := len(f.Include) == 0
+    for _, pattern := range f.Include {
+        included = included || glob_match(pattern, name)
+    }
+    for _, pattern := range f.Exclude {
+        if glob_match(pattern, name) {
+            return false
+        }
+    }
+    return included
+}
+
+// match reports whether the file at a path within a dir is a config file.
+// dirs that aren't env dirs, like the root of a normalized tree, only have
+// the global filter.
+func (filters file_filters) match(dir_name string, name string) bool {
+    return filters.global.match(name) && filters.dirs[path.Clean(dir_name)].match(name)
+}
+
+// glob_match matches a path within a dir, e.g. service1/db.yaml. a glob
+// without a slash matches the file name at any depth, like *.json, and a **
+// matches any number of directories, like legacy/**.
+func glob_match(pattern string, name string) bool {
+    if !strings.Contains(pattern, "/") {
+        ok, _ := path.Match(pattern, path.Base(name))
+        return ok
+    }
+    return glob_match_parts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func glob_match_parts(pattern []string, parts []string) bool {
+    if len(pattern) == 0 {
+        return len(parts) == 0
+    }
+    if pattern[0] == "**" {
+        for i := 0; i <= len(parts); i++ {
+            if glob_match_parts(pattern[1:], parts[i:]) {
+                return true
+            }
+        }
+        return false
+    }
+    if len(parts) == 0 {
+        return false
+    }
+    ok, _ := path.Match(pattern[0], parts[0])
+    return ok && glob_match_parts(pattern[1:], parts[1:])
+}
+
+// copy_files reads the files of the env dirs of a root that aren't config
+// files, which are copied through unchanged to the same place in the other
+// tree
+func copy_files(config opts, r root) (map[string][]byte, error) {
+    copies := map[string][]byte{}
+    g, err := new_group(config, r)
+    if err != nil {
+        return copies, err
+    }
+    // env dirs that can't be read are reported when they're normalized, and
+    // the env dirs of a normalized tree only exist when they hold files
+    fm, _ := g.get_file_map(false)
+    errs := error_list{}
+    for _, name := range fm.unmatched {
+        b, err := r.read_file(name)
+        if err != nil {
+            errs = errs.add(err)
+            continue
+        }
+        copies[name] = b
+    }
+    return copies, errs.err()
+}
@@ -0,0 +1,76 @@
+package carver
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestGlobMatch(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, string, bool]{
+        "name": {"*.json", "app.json", true},
+        "nested name": {"*.json", "service1/app.json", true},
+        "other ext": {"*.json", "README.md", false},
+        "path": {"service1/*.yaml", "service1/db.yaml", true},
+        "path depth": {"service1/*.yaml", "service1/x/db.yaml", false},
+        "double star": {"legacy/**", "legacy/a/b.json", true},
+        "double star middle": {"**/db.yaml", "a/b/db.yaml", true},
+        "double star root": {"**/db.yaml", "db.yaml", true},
+        "hidden": {".DS_Store", "k8s/.DS_Store", true},
+    }
+    runTestsTwoArgsParallel[string, string, bool](t, glob_match, testCases)
+}
+
+func TestFileFiltersMatch(t * testing.T) {
+    filters, err := new_file_filters(
+        file_filter{[]string{"*.json", "*.yaml"}, []string{"legacy/**"}},
+        map[string]file_filter{"prod": {nil, []string{"debug.json"}}},
+        []string{"dev", "prod"},
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    testCases := map[string]testCaseTwoArgs[string, string, bool]{
+        "included": {"dev", "app.json", true},
+        "not included": {"dev", "README.md", false},
+        "excluded": {"dev", "legacy/app.json", false},
+        "dir excluded": {"prod", "debug.json", false},
+        "other dir": {"dev", "debug.json", true},
+        "root": {".", "debug.json", true},
+    }
+    runTestsTwoArgsParallel[string, string, bool](t, filters.match, testCases)
+}
+
+func TestNewFileFiltersErrors(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[file_filter, map[string]file_filter, string]{
+        "bad pattern": {file_filter{[]string{"[a"}, nil}, nil, `invalid pattern "[a"`},
+        "unknown dir": {file_filter{}, map[string]file_filter{"qa": {}}, "filters for qa, which isn't an env dir"},
+        "bad dir pattern": {file_filter{}, map[string]file_filter{"dev": {nil, []string{""}}}, `filters for dev: invalid pattern ""`},
+    }
+    f := func(global file_filter, dirs map[string]file_filter) string {
+        _, err := new_file_filters(global, dirs, []string{"dev"})
+        if err == nil {
+            return ""
+        }
+        return err.Error()
+    }
+    runTestsTwoArgsParallel[file_filter, map[string]file_filter, string](t, f, testCases)
+}
+
+func TestCopyFiles(t * testing.T) {
+    root := t.TempDir()
+    for _, name := range []string{"dev/app.json", "dev/README.md", "dev/img/logo.png", "prod/app.json"} {
+        os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0750)
+        os.WriteFile(filepath.Join(root, name), []byte(name), 0666)
+    }
+    config := opts{Dirs: []string{"dev", "prod"}, Include: []string{"*.json"}}
+    copies, err := copy_files(config, os_root(root))
+    expected := map[string][]byte{
+        "dev/README.md": []byte("dev/README.md"),
+        "dev/img/logo.png": []byte("dev/img/logo.png"),
+    }
+    if err != nil || !reflect.DeepEqual(copies, expected) {
+        t.Fatalf(`expected %v, got %v (%v)`, expected, copies, err)
+    }
+}
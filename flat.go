@@ -0,0 +1,148 @@
+package carver
+
+import (
+    "fmt"
+    "strings"
+    "encoding/json"
+)
+
+// a flat_entry is one key of a flat file like dotenv or .properties, with
+// the comment and blank lines above it and the comment after its value. the
+// comments of flat files are kept as written, newlines included.
+type flat_entry struct {
+    key string
+    value string
+    style style
+    comment comment
+}
+
+// a flat_file is a parsed flat file. its keys map one to one onto keymap
+// paths, so a key like a.b.c is never nested.
+type flat_file struct {
+    entries []flat_entry
+    // comment holds the comments of the file itself: the ones above a blank
+    // line before the first key, and the ones after the last key
+    comment comment
+    // pending are the comment and blank lines seen since the last key
+    pending []string
+    newline bool
+}
+
+// add_line records a comment or blank line
+func (f *flat_file) add_line(line string) {
+    f.pending = append(f.pending, line)
+}
+
+// add_entry adds a key, which takes the comment lines above it
+func (f *flat_file) add_entry(e flat_entry) {
+    lines := f.pending
+    f.pending = nil
+    if len(f.entries) == 0 {
+        // comments above a blank line at the top belong to the file
+        for i := len(lines) - 1; i > 0; i-- {
+            if lines[i] == "" && strings.TrimSpace(strings.Join(lines[:i], "")) != "" {
+                f.comment.head = flat_text(lines[:i+1])
+                lines = lines[i+1:]
+                break
+            }
+        }
+    }
+    e.comment.head = flat_text(lines)
+    for i, old := range f.entries {
+        if old.key == e.key {
+            // a later line for a key wins, in the place of the first
+            f.entries[i] = e
+            return
+        }
+    }
+    f.entries = append(f.entries, e)
+}
+
+// finish ends the file, keeping the lines after the last key
+func (f *flat_file) finish() {
+    f.comment.foot = flat_text(f.pending)
+    f.pending = nil
+}
+
+func flat_text(lines []string) string {
+    text := ""
+    for _, line := range lines {
+        text += line + "\n"
+    }
+    return text
+}
+
+// flat_lines splits a flat file into lines, noting its trailing newline
+func flat_lines(b []byte) ([]string, bool) {
+    s := strings.ReplaceAll(string(b), "\r\n", "\n")
+    newline := strings.HasSuffix(s, "\n")
+    s = strings.TrimSuffix(s, "\n")
+    if s == "" {
+        return []string{}, newline
+    }
+    return strings.Split(s, "\n"), newline
+}
+
+func (f flat_file) object() map[string]interface{} {
+    obj := map[string]interface{}{}
+    for _, e := range f.entries {
+        obj[e.key] = e.value
+    }
+    return obj
+}
+
+func (f flat_file) layout(format string) layout {
+    l := new_layout(format, f.newline)
+    l.known = true
+    for _, e := range f.entries {
+        p := join_path("", e.key)
+        l.order = append(l.order, p)
+        l.styles[p] = e.style
+        if !e.comment.is_empty() {
+            l.comments[p] = e.comment
+        }
+    }
+    if !f.comment.is_empty() {
+        l.comments[""] = f.comment
+    }
+    return l
+}
+
+// flat_value is the text of a value in a flat file. values read from flat
+// files are strings, but other scalars are written as they are in json.
+func flat_value(v interface{}) (string, error) {
+    switch vv := v.(type) {
+    case nil:
+        return "", fmt.Errorf("flat files have no null")
+    case string:
+        return vv, nil
+    case datetime:
+        return string(vv), nil
+    case bool, json.Number, float64:
+        return json_scalar(vv), nil
+    }
+    return "", fmt.Errorf("flat files hold no objects or arrays")
+}
+
+// encode_flat writes one line for each key of a flat document, with its
+// comments. entry writes the line of a key from its style, when the key has
+// one.
+func encode_flat(doc *doc_node, l layout, entry func(key string, value string, s style, ok bool) string) ([]byte, error) {
+    var sb strings.Builder
+    c := l.comments[""]
+    sb.WriteString(c.head)
+    for _, n := range doc.children {
+        if !n.leaf {
+            return nil, fmt.Errorf("%s: flat files hold no objects or arrays", n.path)
+        }
+        value, err := flat_value(n.value)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", n.path, err)
+        }
+        cm := l.comments[n.path]
+        s, ok := l.styles[n.path]
+        sb.WriteString(cm.head + entry(n.key, value, s, ok) + cm.line + "\n" + cm.foot)
+    }
+    sb.WriteString(c.foot)
+    return []byte(sb.String()), nil
+}
@@ -1,14 +1,8 @@
-module carver
+module github.com/rsutton1/carver
 
 go 1.19
 
 require (
-	github.com/nqd/flat v0.2.0
-	golang.org/x/exp v0.0.0-20230626212559-97b1e661b5df
-)
-
-require (
-	github.com/ghodss/yaml v1.0.0 // indirect
-	github.com/imdario/mergo v0.3.12 // indirect
-	gopkg.in/yaml.v2 v2.3.0 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,501 @@
+package carver
+
+import (
+    "bytes"
+    "fmt"
+    "math/big"
+    "regexp"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// jsonc is json with comments and trailing commas, as in VS Code's
+// settings.json, and json5 adds single quotes, unquoted keys and more number
+// forms. parse_jsonc rewrites such a document as plain json on the same lines,
+// so the json reader can decode it and read its layout, and keeps what the
+// rewrite loses: the comments, the trailing commas, the unquoted keys and the
+// scalars written in a way json has no room for.
+type jsonc_parser struct {
+    b []byte
+    i int
+    line int
+    line_start int
+    out bytes.Buffer
+    comments []jsonc_comment
+    events []jsonc_event
+    styles map[string]style
+    bare_keys bool
+    trailing_commas comma_style
+}
+
+type jsonc_comment struct {
+    text string
+    offset int
+    line int
+    end_line int
+    own_line bool
+}
+
+// a jsonc_event is where a member starts or a container opens or closes, for
+// placing comments. the last member of a container is given at its close.
+type jsonc_event struct {
+    kind string
+    path string
+    offset int
+    last string
+}
+
+func parse_jsonc(b []byte) (*jsonc_parser, error) {
+    p := &jsonc_parser{b: b, line: 1, styles: map[string]style{}}
+    p.space()
+    p.events = append(p.events, jsonc_event{"open", "", p.i, ""})
+    err := p.value("")
+    if err != nil {
+        return p, err
+    }
+    p.space()
+    if p.i < len(p.b) {
+        return p, p.errorf("invalid character %s after top-level value", p.quote_char())
+    }
+    return p, nil
+}
+
+func (p *jsonc_parser) errorf(format string, args ...interface{}) error {
+    return file_error{"", p.line, p.i - p.line_start + 1, fmt.Errorf(format, args...)}
+}
+
+func (p *jsonc_parser) quote_char() string {
+    r, _ := utf8.DecodeRune(p.b[p.i:])
+    return strconv.QuoteRune(r)
+}
+
+// advance moves past n bytes, copying them to the output when copy is set and
+// otherwise writing spaces, and keeping every newline either way
+func (p *jsonc_parser) advance(n int, copy bool) {
+    for end := p.i + n; p.i < end; p.i++ {
+        ch := p.b[p.i]
+        if ch == '\n' {
+            p.line++
+            p.line_start = p.i + 1
+            p.out.WriteByte(ch)
+        } else if copy {
+            p.out.WriteByte(ch)
+        } else if ch != '\r' {
+            p.out.WriteByte(' ')
+        }
+    }
+}
+
+// space moves past whitespace and comments
+func (p *jsonc_parser) space() error {
+    for p.i < len(p.b) {
+        switch {
+        case strings.ContainsRune(" \t\r\n", rune(p.b[p.i])):
+            p.advance(1, true)
+        case bytes.HasPrefix(p.b[p.i:], []byte("//")):
+            end := bytes.IndexByte(p.b[p.i:], '\n')
+            if end < 0 {
+                end = len(p.b) - p.i
+            }
+            p.comment(strings.TrimRight(string(p.b[p.i:p.i+end]), "\r"), end)
+        case bytes.HasPrefix(p.b[p.i:], []byte("/*")):
+            end := bytes.Index(p.b[p.i+2:], []byte("*/"))
+            if end < 0 {
+                return p.errorf("comment is never closed")
+            }
+            text := string(p.b[p.i:p.i+end+4])
+            // lines after the first lose the indentation of the comment
+            col := p.i - p.line_start
+            lines := strings.Split(text, "\n")
+            for i := 1; i < len(lines); i++ {
+                trimmed := strings.TrimLeft(lines[i], " \t")
+                if len(lines[i]) - len(trimmed) > col {
+                    trimmed = lines[i][col:]
+                }
+                lines[i] = trimmed
+            }
+            p.comment(strings.Join(lines, "\n"), end+4)
+        default:
+            return nil
+        }
+    }
+    return nil
+}
+
+func (p *jsonc_parser) comment(text string, n int) {
+    c := jsonc_comment{text, p.i, p.line, p.line, len(bytes.TrimSpace(p.b[p.line_start:p.i])) == 0}
+    p.advance(n, false)
+    c.end_line = p.line
+    p.comments = append(p.comments, c)
+}
+
+func (p *jsonc_parser) value(path string) error {
+    err := p.space()
+    if err != nil {
+        return err
+    }
+    if p.i == len(p.b) {
+        return p.errorf("unexpected end of JSON input")
+    }
+    switch ch := p.b[p.i]; {
+    case ch == '{':
+        return p.object(path)
+    case ch == '[':
+        return p.array(path)
+    case ch == '"' || ch == '\'':
+        s, raw, newlines, err := p.string()
+        if err != nil {
+            return err
+        }
+        // the json goes on the same line, and the lines the string was
+        // continued over follow it
+        p.scalar(path, json_scalar(s), raw)
+        p.out.WriteString(strings.Repeat("\n", newlines))
+        return nil
+    case ch == '-' || ch == '+' || ch == '.' || (ch >= '0' && ch <= '9'):
+        return p.number(path)
+    }
+    word := p.word()
+    switch word {
+    case "true", "false", "null":
+        p.advance(len(word), true)
+        return nil
+    case "Infinity", "NaN":
+        return p.errorf("%s can't be carried as a number", word)
+    }
+    return p.errorf("invalid character %s looking for beginning of value", p.quote_char())
+}
+
+// scalar writes a scalar as json, keeping how it was written when that
+// differs
+func (p *jsonc_parser) scalar(path string, json_text string, raw string) {
+    p.out.WriteString(json_text)
+    if raw != json_text {
+        st := p.styles[path]
+        st.raw = raw
+        st.value = json_text
+        p.styles[path] = st
+    }
+}
+
+var jsonc_ident = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// word reads the identifier at the current position, without moving past it
+func (p *jsonc_parser) word() string {
+    end := p.i
+    for end < len(p.b) && jsonc_ident.Match(p.b[p.i:end+1]) {
+        end++
+    }
+    return string(p.b[p.i:end])
+}
+
+func (p *jsonc_parser) object(path string) error {
+    line := p.line
+    p.advance(1, true)
+    last := ""
+    for {
+        err := p.space()
+        if err != nil {
+            return err
+        }
+        if p.i == len(p.b) {
+            return p.errorf("unexpected end of JSON input")
+        }
+        if p.b[p.i] == '}' {
+            p.events = append(p.events, jsonc_event{"close", path, p.i, last})
+            p.advance(1, true)
+            return nil
+        }
+        start := p.i
+        var key string
+        switch ch := p.b[p.i]; {
+        case ch == '"' || ch == '\'':
+            var newlines int
+            key, _, newlines, err = p.string()
+            if err != nil {
+                return err
+            }
+            p.out.WriteString(json_scalar(key) + strings.Repeat("\n", newlines))
+        case jsonc_ident.Match(p.b[p.i:p.i+1]):
+            key = p.word()
+            p.bare_keys = true
+            p.i += len(key)
+            p.out.WriteString(json_scalar(key))
+        default:
+            return p.errorf("invalid character %s looking for beginning of object key string", p.quote_char())
+        }
+        last = join_path(path, key)
+        if p.b[start] == '\'' {
+            p.styles[last] = style{quote: "'"}
+        }
+        p.events = append(p.events, jsonc_event{"member", last, start, ""})
+        err = p.space()
+        if err != nil {
+            return err
+        }
+        if p.i == len(p.b) || p.b[p.i] != ':' {
+            if p.i == len(p.b) {
+                return p.errorf("unexpected end of JSON input")
+            }
+            return p.errorf("invalid character %s after object key", p.quote_char())
+        }
+        p.advance(1, true)
+        err = p.value(last)
+        if err != nil {
+            return err
+        }
+        done, err := p.separator('}', "object key:value pair", line)
+        if err != nil || done {
+            if done {
+                p.events = append(p.events, jsonc_event{"close", path, p.i, last})
+                p.advance(1, true)
+            }
+            return err
+        }
+    }
+}
+
+func (p *jsonc_parser) array(path string) error {
+    line := p.line
+    p.advance(1, true)
+    last := ""
+    for i := 0; ; i++ {
+        err := p.space()
+        if err != nil {
+            return err
+        }
+        if p.i == len(p.b) {
+            return p.errorf("unexpected end of JSON input")
+        }
+        if p.b[p.i] == ']' {
+            p.events = append(p.events, jsonc_event{"close", path, p.i, last})
+            p.advance(1, true)
+            return nil
+        }
+        last = join_path(path, strconv.Itoa(i))
+        p.events = append(p.events, jsonc_event{"member", last, p.i, ""})
+        err = p.value(last)
+        if err != nil {
+            return err
+        }
+        done, err := p.separator(']', "array element", line)
+        if err != nil || done {
+            if done {
+                p.events = append(p.events, jsonc_event{"close", path, p.i, last})
+                p.advance(1, true)
+            }
+            return err
+        }
+    }
+}
+
+// separator reads the comma after a member, or the close of its container
+// opened on line. a comma right before the close is dropped from the json.
+func (p *jsonc_parser) separator(close byte, after string, line int) (bool, error) {
+    err := p.space()
+    if err != nil {
+        return false, err
+    }
+    if p.i == len(p.b) {
+        return false, p.errorf("unexpected end of JSON input")
+    }
+    if p.b[p.i] == close {
+        return true, nil
+    }
+    if p.b[p.i] != ',' {
+        return false, p.errorf("invalid character %s after %s", p.quote_char(), after)
+    }
+    comma := p.out.Len()
+    p.advance(1, true)
+    err = p.space()
+    if err != nil {
+        return false, err
+    }
+    if p.i < len(p.b) && p.b[p.i] == close {
+        p.out.Bytes()[comma] = ' '
+        p.trailing_commas.set(close == ']', p.line > line)
+        return true, nil
+    }
+    return false, nil
+}
+
+// string reads a single or double quoted string, returning its value, the
+// text it was written as and the number of lines it was continued over
+func (p *jsonc_parser) string() (string, string, int, error) {
+    quote := p.b[p.i]
+    start := p.i
+    var sb strings.Builder
+    newlines := 0
+    i := p.i + 1
+    for {
+        if i >= len(p.b) || p.b[i] == '\n' {
+            p.i = i
+            return "", "", 0, p.errorf("string is never closed")
+        }
+        ch := p.b[i]
+        if ch == quote {
+            break
+        }
+        if ch != '\\' {
+            sb.WriteByte(ch)
+            i++
+            continue
+        }
+        i++
+        if i == len(p.b) {
+            continue
+        }
+        switch e := p.b[i]; e {
+        case 'n':
+            sb.WriteByte('\n')
+        case 'r':
+            sb.WriteByte('\r')
+        case 't':
+            sb.WriteByte('\t')
+        case 'b':
+            sb.WriteByte('\b')
+        case 'f':
+            sb.WriteByte('\f')
+        case 'v':
+            sb.WriteByte('\v')
+        case '0':
+            sb.WriteByte(0)
+        case '\n':
+            // a json5 string continued on the next line
+            newlines++
+        case '\r':
+            if i+1 < len(p.b) && p.b[i+1] == '\n' {
+                i++
+            }
+            newlines++
+        case 'x', 'u':
+            n := 2
+            if e == 'u' {
+                n = 4
+            }
+            if i+n >= len(p.b) {
+                p.i = i
+                return "", "", 0, p.errorf("invalid escape")
+            }
+            r, err := strconv.ParseUint(string(p.b[i+1:i+1+n]), 16, 32)
+            if err != nil {
+                p.i = i
+                return "", "", 0, p.errorf("invalid escape \\%c%s", e, p.b[i+1:i+1+n])
+            }
+            i += n
+            if r >= 0xd800 && r < 0xdc00 && bytes.HasPrefix(p.b[i+1:], []byte("\\u")) && i+7 <= len(p.b) {
+                low, err := strconv.ParseUint(string(p.b[i+3:i+7]), 16, 32)
+                if err == nil && low >= 0xdc00 && low < 0xe000 {
+                    r = (r - 0xd800) << 10 + (low - 0xdc00) + 0x10000
+                    i += 6
+                }
+            }
+            sb.WriteRune(rune(r))
+        default:
+            sb.WriteByte(e)
+        }
+        i++
+    }
+    p.i = i + 1
+    p.line += newlines
+    if newlines > 0 {
+        p.line_start = bytes.LastIndexByte(p.b[:p.i], '\n') + 1
+    }
+    return sb.String(), string(p.b[start:i+1]), newlines, nil
+}
+
+var json_number = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+var jsonc_number = regexp.MustCompile(`^[-+]?(0[xX][0-9a-fA-F]+|[0-9]*\.?[0-9]*([eE][-+]?[0-9]+)?|Infinity|NaN)`)
+
+func (p *jsonc_parser) number(path string) error {
+    raw := jsonc_number.FindString(string(p.b[p.i:]))
+    text := strings.TrimPrefix(raw, "+")
+    sign := ""
+    if strings.HasPrefix(text, "-") {
+        sign = "-"
+        text = text[1:]
+    }
+    switch {
+    case text == "Infinity" || text == "NaN":
+        return p.errorf("%s can't be carried as a number", raw)
+    case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"):
+        n, _ := new(big.Int).SetString(text[2:], 16)
+        text = n.String()
+    default:
+        if strings.HasPrefix(text, ".") {
+            text = "0" + text
+        }
+        text = strings.Replace(text, ".e", ".0e", 1)
+        text = strings.Replace(text, ".E", ".0E", 1)
+        if strings.HasSuffix(text, ".") {
+            text += "0"
+        }
+    }
+    text = sign + text
+    if !strings.ContainsAny(raw, "0123456789") || !json_number.MatchString(text) {
+        return p.errorf("invalid character %s looking for beginning of value", p.quote_char())
+    }
+    p.i += len(raw)
+    p.scalar(path, text, raw)
+    return nil
+}
+
+// layout reads the layout of the document, with its comments placed on the
+// keys they belong to
+func (p *jsonc_parser) layout(l layout) layout {
+    json_layout(p.out.Bytes(), &l)
+    l.styles = p.styles
+    l.trailing_commas = p.trailing_commas
+    l.bare_keys = p.bare_keys
+    heads := map[string]int{}
+    add := func(path string, part string, c jsonc_comment) {
+        cm := l.comments[path]
+        switch part {
+        case "head":
+            if cm.head != "" && c.line > heads[path] + 1 {
+                cm.head += "\n"
+            }
+            cm.head = join_comments(cm.head, c.text)
+            heads[path] = c.end_line
+        case "line":
+            if cm.line != "" {
+                cm.line += " "
+            }
+            cm.line += c.text
+        case "foot":
+            cm.foot = join_comments(cm.foot, c.text)
+        }
+        l.comments[path] = cm
+    }
+    for _, c := range p.comments {
+        // the first event after the comment, and the last one before it
+        next := len(p.events)
+        for i, e := range p.events {
+            if e.offset > c.offset {
+                next = i
+                break
+            }
+        }
+        if !c.own_line && next > 0 {
+            e := p.events[next-1]
+            add(e.path, "line", c)
+            continue
+        }
+        if next == len(p.events) {
+            add("", "foot", c)
+            continue
+        }
+        switch e := p.events[next]; e.kind {
+        case "open":
+            add("", "head", c)
+        case "member":
+            add(e.path, "head", c)
+        case "close":
+            if e.last != "" {
+                add(e.last, "foot", c)
+            }
+        }
+    }
+    return l
+}
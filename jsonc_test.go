@@ -0,0 +1,100 @@
+package carver
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestJsoncRoundTrip(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "comments": {
+            "// top\n{\n  // about a\n  \"a\": 1, // one\n  \"b\": {\n    \"c\": [1, 2] // list\n    // end of b\n  }\n}\n// bottom\n",
+            "// top\n{\n  // about a\n  \"a\": 1, // one\n  \"b\": {\n    \"c\": [1, 2] // list\n    // end of b\n  }\n}\n// bottom\n",
+        },
+        "container_line_comment": {
+            "{\n  \"a\": { // about a\n    \"b\": 1\n  }\n}",
+            "{\n  \"a\": { // about a\n    \"b\": 1\n  }\n}",
+        },
+        "block_comment": {
+            "{\n    /* one\n       two */\n    \"a\": 1,\n    // before a gap\n\n    // more\n    \"b\": 2\n}",
+            "{\n    /* one\n       two */\n    \"a\": 1,\n    // before a gap\n\n    // more\n    \"b\": 2\n}",
+        },
+        "trailing_commas": {
+            "{\n  \"a\": [\n    1,\n    2,\n  ],\n  \"b\": true,\n}",
+            "{\n  \"a\": [\n    1,\n    2,\n  ],\n  \"b\": true,\n}",
+        },
+        "inline_trailing_commas": {
+            "{\n  arr: [1, 2,],\n  obj: {a: 1},\n}",
+            "{\n  arr: [1, 2,],\n  obj: {a: 1},\n}",
+        },
+        "array_trailing_commas": {
+            "{\n  \"a\": [\n    1,\n    2,\n  ],\n  \"b\": true\n}",
+            "{\n  \"a\": [\n    1,\n    2,\n  ],\n  \"b\": true\n}",
+        },
+        "json5": {
+            "{\n  name: 'app',\n  'key-two': \"x\",\n  port: 0x1F90,\n  half: .5,\n  plus: +1,\n  text: 'it\\'s',\n  long: 'a\\\nb',\n}",
+            "{\n  name: 'app',\n  'key-two': \"x\",\n  port: 0x1F90,\n  half: .5,\n  plus: +1,\n  text: 'it\\'s',\n  long: 'a\\\nb',\n}",
+        },
+    }
+    f := func(in string) string {
+        obj, err := json_codec{}.decode([]byte(in))
+        if err != nil {
+            return err.Error()
+        }
+        flattened, _ := flatten(obj, nil)
+        b, _ := encode_file(flattened, json_codec{}.read_layout([]byte(in)).rekey(obj, nil), json_codec{})
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestJsoncDecode(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "comments_and_commas": {
+            "{\n  // c\n  \"url\": \"http://x\", /* d */\n  \"list\": [1, 2,],\n}",
+            `{"list":[1,2],"url":"http://x"}`,
+        },
+        "json5": {
+            "{a: 'b\\'c', hex: 0xff, half: -.5, plus: +2., esc: '\\x41\\u0042'}",
+            `{"a":"b'c","esc":"AB","half":-0.5,"hex":255,"plus":2.0}`,
+        },
+        "changed_value": {
+            "{a: 0x10}",
+            `{"a":16}`,
+        },
+        "infinity": {
+            "{\n  a: Infinity\n}",
+            ":2:6: Infinity can't be carried as a number",
+        },
+        "missing_colon": {
+            "{\n  // c\n  \"a\" 1\n}",
+            ":3:7: invalid character '1' after object key",
+        },
+        "unclosed_comment": {
+            "{\"a\": 1 /* c",
+            ":1:9: comment is never closed",
+        },
+        "unclosed_string": {
+            "{\"a\": 'b\n}",
+            ":1:9: string is never closed",
+        },
+    }
+    f := func(in string) string {
+        obj, err := json_codec{}.decode([]byte(in))
+        if err != nil {
+            return json_codec{}.decode_error("", []byte(in), err).Error()
+        }
+        b, _ := json.Marshal(obj)
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestJson5ChangedValue(t * testing.T) {
+    in := "{port: 0x10, name: 'a'}"
+    l := json_codec{}.read_layout([]byte(in))
+    b, _ := encode_file(map[string]interface{}{"/port": json.Number("17"), "/name": "b"}, l, json_codec{})
+    if string(b) != "{port: 17, name: \"b\"}" {
+        t.Fatalf(`expected changed values in json, got %s`, b)
+    }
+}
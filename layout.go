@@ -0,0 +1,538 @@
+package carver
+
+import (
+    "bytes"
+    "sort"
+    "strconv"
+    "strings"
+    "encoding/json"
+    "gopkg.in/yaml.v3"
+)
+
+// a layout records how a file is written: the order of its flattened keys and
+// its whitespace. carver writes files back with the layout of the file it
+// replaces, or of the files it was built from, so untouched files don't
+// change.
+type layout struct {
+    // format is the name of the codec the file is written with
+    format string
+    order []string
+    // indent is one level of indentation. an empty indent means the file is
+    // written on a single line.
+    indent string
+    // seq_indent is how far yaml sequences are indented below their key
+    seq_indent string
+    // inline holds the objects and arrays that are written on one line
+    inline map[string]bool
+    // comments holds the yaml comments of each key. the comments of the
+    // document itself are kept under the empty path.
+    comments map[string]comment
+    // tight_headers holds the toml tables whose header has no blank line
+    // above it
+    tight_headers map[string]bool
+    // styles holds how each key of a flat file like dotenv was written, and
+    // the json5 and yaml scalars that were written in a way carver doesn't
+    // write them
+    styles map[string]style
+    // anchors holds the yaml anchors, aliases and merge keys of each key
+    anchors map[string]anchor
+    // trailing_commas says which objects and arrays a jsonc or json5 file
+    // ends with a comma, and bare_keys is set when it leaves keys unquoted
+    trailing_commas comma_style
+    bare_keys bool
+    // arrays are the strategies the keys were flattened with, which say
+    // which objects are written back as arrays
+    arrays array_strategies
+    // index_arrays holds the arrays that were split by index. an object
+    // keyed 0 to n-1 is only written as an array when its path is here.
+    index_arrays map[string]bool
+    newline bool
+    // known is set when the whitespace was read from a file
+    known bool
+}
+
+// a style is how a key of a flat file was written: the text before the key,
+// the separator after it, the quote around the value and the value as written,
+// which is kept while the value doesn't change
+type style struct {
+    lead string
+    sep string
+    quote string
+    raw string
+    value string
+}
+
+// a comment is the text of the comment lines above a key, after its value and
+// below it, including the leading #
+type comment struct {
+    head string
+    line string
+    foot string
+}
+
+func (c comment) is_empty() bool {
+    return c.head == "" && c.line == "" && c.foot == ""
+}
+
+func join_comments(a string, b string) string {
+    if a == "" || b == "" {
+        return a + b
+    }
+    return a + "\n" + b
+}
+
+// paths are json pointers (RFC 6901), e.g. /spec/args/0, so keys may contain
+// any character. the empty path is the whole document.
+var path_escaper = strings.NewReplacer("~", "~0", "/", "~1")
+var path_unescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+func join_path(prefix string, key string) string {
+    return prefix + "/" + path_escaper.Replace(key)
+}
+
+func split_path(p string) []string {
+    if p == "" {
+        return []string{}
+    }
+    parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+    for i, part := range parts {
+        parts[i] = path_unescaper.Replace(part)
+    }
+    return parts
+}
+
+func parent_path(p string) string {
+    i := strings.LastIndex(p, "/")
+    if i < 0 {
+        return ""
+    }
+    return p[:i]
+}
+
+// json_layout reads the layout of a valid json document into l
+func json_layout(b []byte, l *layout) {
+    l.known = true
+    l.newline = bytes.HasSuffix(b, []byte("\n"))
+    l.order, l.inline = json_order(b)
+    l.indent = json_indent(b)
+    if l.indent == "" && bytes.Contains(b, []byte("\": ")) {
+        // a single line with spaces after its colons and commas
+        l.indent = "  "
+        l.inline[""] = true
+    }
+}
+
+// json_order lists the flattened keys of a json document in order, and the
+// objects and arrays that fit on one line
+func json_order(b []byte) ([]string, map[string]bool) {
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    order := []string{}
+    inline := map[string]bool{}
+    var walk func(prefix string) error
+    walk = func(prefix string) error {
+        start := dec.InputOffset()
+        tok, err := dec.Token()
+        if err != nil {
+            return err
+        }
+        defer func() {
+            span := b[start:dec.InputOffset()]
+            open := bytes.IndexAny(span, "{[")
+            if tok == json.Delim('{') || tok == json.Delim('[') {
+                inline[prefix] = !bytes.Contains(span[open:], []byte("\n"))
+            }
+        }()
+        switch tok {
+        case json.Delim('{'):
+            empty := true
+            for dec.More() {
+                empty = false
+                key, err := dec.Token()
+                if err != nil {
+                    return err
+                }
+                err = walk(join_path(prefix, key.(string)))
+                if err != nil {
+                    return err
+                }
+            }
+            dec.Token()
+            if empty {
+                order = append(order, prefix)
+            }
+        case json.Delim('['):
+            i := 0
+            for ; dec.More(); i++ {
+                err = walk(join_path(prefix, strconv.Itoa(i)))
+                if err != nil {
+                    return err
+                }
+            }
+            dec.Token()
+            if i == 0 {
+                order = append(order, prefix)
+            }
+        default:
+            order = append(order, prefix)
+        }
+        return nil
+    }
+    walk("")
+    return order, inline
+}
+
+// json_indent returns the leading whitespace of the first indented line
+func json_indent(b []byte) string {
+    lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+    if len(lines) < 2 {
+        return ""
+    }
+    for _, line := range lines[1:] {
+        trimmed := strings.TrimLeft(line, " \t")
+        if trimmed != "" && len(trimmed) < len(line) {
+            return line[:len(line)-len(trimmed)]
+        }
+    }
+    return "  "
+}
+
+func yaml_order(n *yaml.Node, prefix string, order *[]string) {
+    switch n.Kind {
+    case yaml.DocumentNode:
+        for _, c := range n.Content {
+            yaml_order(c, prefix, order)
+        }
+    case yaml.AliasNode:
+        yaml_order(n.Alias, prefix, order)
+    case yaml.MappingNode:
+        if len(n.Content) == 0 {
+            *order = append(*order, prefix)
+        }
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            if n.Content[i].ShortTag() == "!!merge" {
+                continue
+            }
+            yaml_order(n.Content[i+1], join_path(prefix, n.Content[i].Value), order)
+        }
+    case yaml.SequenceNode:
+        if len(n.Content) == 0 {
+            *order = append(*order, prefix)
+        }
+        for i, c := range n.Content {
+            yaml_order(c, join_path(prefix, strconv.Itoa(i)), order)
+        }
+    default:
+        *order = append(*order, prefix)
+    }
+}
+
+// yaml_indent measures the first nested mapping and the first sequence
+// below a key, and finds the flow style objects and arrays
+func yaml_indent(n *yaml.Node, prefix string, l *layout) {
+    found_indent := false
+    found_seq := false
+    var walk func(n *yaml.Node, prefix string)
+    walk = func(n *yaml.Node, prefix string) {
+        if n.Kind == yaml.DocumentNode {
+            for _, c := range n.Content {
+                walk(c, prefix)
+            }
+            return
+        }
+        if n.Style & yaml.FlowStyle != 0 && len(n.Content) > 0 {
+            l.inline[prefix] = true
+            return
+        }
+        if n.Kind == yaml.SequenceNode {
+            for i, c := range n.Content {
+                walk(c, join_path(prefix, strconv.Itoa(i)))
+            }
+            return
+        }
+        if n.Kind != yaml.MappingNode {
+            return
+        }
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            key := n.Content[i]
+            value := n.Content[i+1]
+            if value.Style & yaml.FlowStyle == 0 && len(value.Content) > 0 {
+                // an anchor moves the column of a value to the anchor, so
+                // mappings are measured at their first key
+                first := value.Content[0]
+                if value.Kind == yaml.MappingNode && !found_indent && first.Column > key.Column {
+                    l.indent = strings.Repeat(" ", first.Column - key.Column)
+                    found_indent = true
+                }
+                if value.Kind == yaml.SequenceNode && !found_seq {
+                    // the column of a sequence is the column of its first
+                    // dash, which comes two before its first item
+                    column := value.Column
+                    if value.Anchor != "" {
+                        column = first.Column - 2
+                    }
+                    if column > key.Column {
+                        l.seq_indent = strings.Repeat(" ", column - key.Column)
+                    }
+                    found_seq = true
+                }
+            }
+            walk(value, join_path(prefix, key.Value))
+        }
+    }
+    walk(n, prefix)
+}
+
+// yaml_comments collects the comments of each key of a yaml document
+func yaml_comments(n *yaml.Node, prefix string, comments map[string]comment) {
+    add := func(p string, c comment) {
+        if !c.is_empty() {
+            comments[p] = c
+        }
+    }
+    switch n.Kind {
+    case yaml.DocumentNode:
+        c := comment{n.HeadComment, "", n.FootComment}
+        for _, child := range n.Content {
+            c.head = join_comments(c.head, child.HeadComment)
+            c.foot = join_comments(child.FootComment, c.foot)
+            yaml_comments(child, prefix, comments)
+        }
+        add(prefix, c)
+    case yaml.MappingNode:
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            key := n.Content[i]
+            value := n.Content[i+1]
+            p := join_path(prefix, key.Value)
+            add(p, comment{
+                join_comments(key.HeadComment, value.HeadComment),
+                join_comments(key.LineComment, value.LineComment),
+                join_comments(value.FootComment, key.FootComment),
+            })
+            if value.Style & yaml.FlowStyle == 0 {
+                yaml_comments(value, p, comments)
+            }
+        }
+    case yaml.SequenceNode:
+        for i, item := range n.Content {
+            p := join_path(prefix, strconv.Itoa(i))
+            add(p, comment{item.HeadComment, item.LineComment, item.FootComment})
+            if item.Style & yaml.FlowStyle == 0 {
+                yaml_comments(item, p, comments)
+            }
+        }
+    }
+}
+
+// merge_orders combines key orders. keys missing from the earlier orders are
+// placed after the key they follow in the later ones.
+func merge_orders(orders ...[]string) []string {
+    merged := []string{}
+    for _, order := range orders {
+        merged = insert_keys(merged, order)
+    }
+    return merged
+}
+
+func insert_keys(order []string, keys []string) []string {
+    known := map[string]bool{}
+    for _, k := range order {
+        known[k] = true
+    }
+    after := map[string][]string{}
+    first := []string{}
+    prev := ""
+    for i, k := range keys {
+        if known[k] {
+            prev = k
+            continue
+        }
+        known[k] = true
+        if i == 0 {
+            first = append(first, k)
+        } else {
+            after[prev] = append(after[prev], k)
+        }
+        prev = k
+    }
+    merged := []string{}
+    var add func(k string)
+    add = func(k string) {
+        merged = append(merged, k)
+        for _, next := range after[k] {
+            add(next)
+        }
+    }
+    for _, k := range first {
+        add(k)
+    }
+    for _, k := range order {
+        add(k)
+    }
+    return merged
+}
+
+// order_keys orders the keys of obj by the layout, with keys the layout
+// doesn't know at the end in sorted order
+func order_keys(obj map[string]interface{}, order []string) []string {
+    keys := []string{}
+    seen := map[string]bool{}
+    for _, k := range order {
+        if _, ok := obj[k]; ok && !seen[k] {
+            keys = append(keys, k)
+            seen[k] = true
+        }
+    }
+    rest := []string{}
+    for k := range obj {
+        if !seen[k] {
+            rest = append(rest, k)
+        }
+    }
+    sort.Strings(rest)
+    return append(keys, rest...)
+}
+
+// a comma_style says which containers end with a comma after their last
+// member, by kind and by whether they're written over several lines
+type comma_style struct {
+    object bool
+    array bool
+    inline_object bool
+    inline_array bool
+}
+
+func (s *comma_style) set(array bool, multiline bool) {
+    switch {
+    case array && multiline:
+        s.array = true
+    case array:
+        s.inline_array = true
+    case multiline:
+        s.object = true
+    default:
+        s.inline_object = true
+    }
+}
+
+func (s comma_style) get(array bool, multiline bool) bool {
+    switch {
+    case array && multiline:
+        return s.array
+    case array:
+        return s.inline_array
+    case multiline:
+        return s.object
+    }
+    return s.inline_object
+}
+
+// with_fallback keeps the order and whitespace of l, and places the keys it
+// doesn't know the way the fallback does. the comments always come from the
+// fallback, since they travel with the keys.
+func (l layout) with_fallback(fallback layout) layout {
+    l.order = merge_orders(l.order, fallback.order)
+    l.inline = merge_inline(l.inline, fallback.inline)
+    l.comments = fallback.comments
+    l.tight_headers = merge_inline(l.tight_headers, fallback.tight_headers)
+    l.styles = merge_styles(fallback.styles, l.styles)
+    l.anchors = merge_anchors(fallback.anchors, l.anchors)
+    l.arrays = fallback.arrays
+    l.index_arrays = merge_inline(l.index_arrays, fallback.index_arrays)
+    return l
+}
+
+func merge_inline(inlines ...map[string]bool) map[string]bool {
+    merged := map[string]bool{}
+    for i := len(inlines) - 1; i >= 0; i-- {
+        for p, v := range inlines[i] {
+            merged[p] = v
+        }
+    }
+    return merged
+}
+
+func merge_comments(comments ...map[string]comment) map[string]comment {
+    merged := map[string]comment{}
+    for i := len(comments) - 1; i >= 0; i-- {
+        for p, c := range comments[i] {
+            merged[p] = c
+        }
+    }
+    return merged
+}
+
+func merge_styles(styles ...map[string]style) map[string]style {
+    merged := map[string]style{}
+    for i := len(styles) - 1; i >= 0; i-- {
+        for p, s := range styles[i] {
+            merged[p] = s
+        }
+    }
+    return merged
+}
+
+func merge_anchors(anchors ...map[string]anchor) map[string]anchor {
+    merged := map[string]anchor{}
+    for i := len(anchors) - 1; i >= 0; i-- {
+        for p, a := range anchors[i] {
+            merged[p] = a
+        }
+    }
+    return merged
+}
+
+// get_layout is the fallback layout for a file written from this group. the
+// order comes from the file with the same name first and then from the rest
+// in load order, and the whitespace from the first of them in the same
+// format.
+func (kmg keymap_group) get_layout(name string) layout {
+    names := kmg.km.get_names()
+    if _, ok := kmg.layouts[name]; ok {
+        names = append([]string{name}, names...)
+    }
+    var c codec = yaml_codec{}
+    for _, n := range names {
+        if source := codec_named(kmg.layouts[n].format); source != nil {
+            c = source
+            break
+        }
+    }
+    if target, err := codec_for(name, nil); err == nil {
+        c = target
+    }
+    l := c.default_layout()
+    orders := [][]string{}
+    inlines := []map[string]bool{}
+    comments := []map[string]comment{}
+    tight_headers := []map[string]bool{}
+    styles := []map[string]style{}
+    anchors := []map[string]anchor{}
+    arrays := array_strategies{}
+    index_arrays := []map[string]bool{}
+    for _, n := range names {
+        source := kmg.layouts[n]
+        if source.arrays != nil {
+            arrays = source.arrays
+        }
+        index_arrays = append(index_arrays, source.index_arrays)
+        orders = append(orders, source.order)
+        inlines = append(inlines, source.inline)
+        comments = append(comments, source.comments)
+        tight_headers = append(tight_headers, source.tight_headers)
+        styles = append(styles, source.styles)
+        anchors = append(anchors, source.anchors)
+        if !l.known && source.known && source.format == l.format {
+            l = source
+        }
+    }
+    l.order = merge_orders(orders...)
+    l.inline = merge_inline(inlines...)
+    l.comments = merge_comments(comments...)
+    l.tight_headers = merge_inline(tight_headers...)
+    l.styles = merge_styles(styles...)
+    l.anchors = merge_anchors(anchors...)
+    l.arrays = arrays
+    l.index_arrays = merge_inline(index_arrays...)
+    return l
+}
@@ -0,0 +1,39 @@
+package carver
+
+import (
+    "context"
+    "runtime"
+    "sync"
+)
+
+// worker_count is the number of jobs run at once, every CPU unless jobs says
+// otherwise
+func worker_count(jobs int) int {
+    if jobs <= 0 {
+        return runtime.NumCPU()
+    }
+    return jobs
+}
+
+// run_jobs calls f with every index below n, on at most jobs goroutines at
+// once. f stores its result at its index, so the results come out in the
+// same order however the jobs are scheduled, and each job only touches the
+// keymap group at its own index. once ctx is done no more jobs are started.
+func run_jobs(ctx context.Context, jobs int, n int, f func(i int)) {
+    indexes := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < worker_count(jobs) && w < n; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range indexes {
+                f(i)
+            }
+        }()
+    }
+    for i := 0; i < n && ctx.Err() == nil; i++ {
+        indexes <- i
+    }
+    close(indexes)
+    wg.Wait()
+}
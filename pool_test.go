@@ -0,0 +1,49 @@
+package carver
+
+import (
+    "context"
+    "reflect"
+    "sync/atomic"
+    "testing"
+)
+
+func TestRunJobs(t * testing.T) {
+    type result struct {
+        Visits []int
+        Bounded bool
+    }
+    testCases := map[string]testCaseOneArg[int, result]{
+        "one": {1, result{[]int{1, 1, 1, 1, 1, 1, 1, 1}, true}},
+        "some": {3, result{[]int{1, 1, 1, 1, 1, 1, 1, 1}, true}},
+        "more than jobs": {20, result{[]int{1, 1, 1, 1, 1, 1, 1, 1}, true}},
+    }
+    f := func(jobs int) result {
+        visits := make([]int, 8)
+        var running, most int32
+        run_jobs(context.Background(), jobs, len(visits), func(i int) {
+            n := atomic.AddInt32(&running, 1)
+            for {
+                m := atomic.LoadInt32(&most)
+                if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+                    break
+                }
+            }
+            visits[i]++
+            atomic.AddInt32(&running, -1)
+        })
+        return result{visits, int(most) <= jobs}
+    }
+    runTestsOneArgParallel[int, result](t, f, testCases)
+}
+
+func TestRunJobsCanceled(t * testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    visits := make([]int, 8)
+    run_jobs(ctx, 2, len(visits), func(i int) {
+        visits[i]++
+    })
+    if !reflect.DeepEqual(visits, make([]int, 8)) {
+        t.Fatalf(`expected a canceled run to start nothing, got %v`, visits)
+    }
+}
@@ -0,0 +1,197 @@
+package carver
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// properties_codec reads and writes java .properties files: lines of
+// key=value, key: value or key value, with backslash escapes and lines
+// continued by a trailing backslash
+type properties_codec struct{}
+
+func (properties_codec) name() string {
+    return "properties"
+}
+
+func (properties_codec) exts() []string {
+    return []string{".properties"}
+}
+
+// sniff never matches, since any text reads as .properties
+func (properties_codec) sniff(b []byte) bool {
+    return false
+}
+
+func (properties_codec) decode(b []byte) (map[string]interface{}, error) {
+    f, err := parse_properties(b)
+    return f.object(), err
+}
+
+func (properties_codec) decode_error(path string, b []byte, err error) error {
+    return place_error(path, err)
+}
+
+func (properties_codec) read_layout(b []byte) layout {
+    f, err := parse_properties(b)
+    if err != nil {
+        return new_layout("properties", true)
+    }
+    return f.layout("properties")
+}
+
+func (properties_codec) default_layout() layout {
+    return new_layout("properties", true)
+}
+
+func (properties_codec) encode(doc *doc_node, l layout) ([]byte, error) {
+    return encode_flat(doc, l, properties_entry)
+}
+
+func parse_properties(b []byte) (flat_file, error) {
+    f := flat_file{}
+    lines, newline := flat_lines(b)
+    f.newline = newline
+    for i := 0; i < len(lines); i++ {
+        line_number := i + 1
+        line := lines[i]
+        text := strings.TrimLeft(line, " \t\f")
+        if text == "" || text[0] == '#' || text[0] == '!' {
+            f.add_line(line)
+            continue
+        }
+        lead := line[:len(line)-len(text)]
+        for properties_continued(text) && i+1 < len(lines) {
+            i++
+            text += "\n" + lines[i]
+        }
+        // the key ends at the first unescaped separator or space
+        k := 0
+        for k < len(text) && !strings.ContainsRune("=: \t\f\n", rune(text[k])) {
+            if text[k] == '\\' {
+                k++
+            }
+            k++
+        }
+        if k > len(text) {
+            k = len(text)
+        }
+        sep_end := k
+        for sep_end < len(text) && strings.ContainsRune(" \t\f", rune(text[sep_end])) {
+            sep_end++
+        }
+        if sep_end < len(text) && (text[sep_end] == '=' || text[sep_end] == ':') {
+            sep_end++
+            for sep_end < len(text) && strings.ContainsRune(" \t\f", rune(text[sep_end])) {
+                sep_end++
+            }
+        }
+        key, err := properties_unescape(text[:k])
+        if err != nil {
+            return f, file_error{"", line_number, 0, err}
+        }
+        raw := text[sep_end:]
+        value, err := properties_unescape(raw)
+        if err != nil {
+            return f, file_error{"", line_number, 0, err}
+        }
+        f.add_entry(flat_entry{key, value, style{lead, text[k:sep_end], "", raw, value}, comment{}})
+    }
+    f.finish()
+    return f, nil
+}
+
+// properties_continued reports whether a line ends in an odd number of
+// backslashes, which continues it on the next line
+func properties_continued(line string) bool {
+    n := 0
+    for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+        n++
+    }
+    return n % 2 == 1
+}
+
+func properties_unescape(s string) (string, error) {
+    var sb strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] != '\\' {
+            sb.WriteByte(s[i])
+            continue
+        }
+        i++
+        if i == len(s) {
+            break
+        }
+        switch s[i] {
+        case '\n':
+            // a continued line, whose leading space is dropped
+            for i+1 < len(s) && strings.ContainsRune(" \t\f", rune(s[i+1])) {
+                i++
+            }
+        case 't':
+            sb.WriteByte('\t')
+        case 'n':
+            sb.WriteByte('\n')
+        case 'r':
+            sb.WriteByte('\r')
+        case 'f':
+            sb.WriteByte('\f')
+        case 'u':
+            if i+5 > len(s) {
+                return "", fmt.Errorf("malformed \\u escape")
+            }
+            r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+            if err != nil {
+                return "", fmt.Errorf("malformed \\u escape %q", s[i-1:i+5])
+            }
+            sb.WriteRune(rune(r))
+            i += 4
+        default:
+            sb.WriteByte(s[i])
+        }
+    }
+    return sb.String(), nil
+}
+
+func properties_escape(s string, is_key bool) string {
+    var sb strings.Builder
+    for i, r := range s {
+        switch {
+        case r == '\\':
+            sb.WriteString("\\\\")
+        case r == '\n':
+            sb.WriteString("\\n")
+        case r == '\r':
+            sb.WriteString("\\r")
+        case r == '\t':
+            sb.WriteString("\\t")
+        case r == '\f':
+            sb.WriteString("\\f")
+        case r == ' ' && (is_key || i == 0):
+            sb.WriteString("\\ ")
+        case (r == '=' || r == ':') && is_key:
+            sb.WriteRune('\\')
+            sb.WriteRune(r)
+        case (r == '#' || r == '!') && is_key && i == 0:
+            sb.WriteRune('\\')
+            sb.WriteRune(r)
+        default:
+            sb.WriteRune(r)
+        }
+    }
+    return sb.String()
+}
+
+// properties_entry writes the line of a key. a value that hasn't changed is
+// written as it was, line continuations and all.
+func properties_entry(key string, value string, s style, ok bool) string {
+    if !ok {
+        s = style{sep: "="}
+    }
+    raw := properties_escape(value, false)
+    if ok && s.value == value {
+        raw = s.raw
+    }
+    return s.lead + properties_escape(key, true) + s.sep + raw
+}
@@ -0,0 +1,79 @@
+package carver
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestPropertiesRoundTrip(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "separators": {
+            "a=1\nb = 2\nc: 3\nd 4\n",
+            "a=1\nb = 2\nc: 3\nd 4\n",
+        },
+        "comments": {
+            "# spring\n\n! about a\na=1\n\nb=2\n# end\n",
+            "# spring\n\n! about a\na=1\n\nb=2\n# end\n",
+        },
+        "continuation_and_escapes": {
+            "list = a,\\\n    b\nkey\\ one=x\nu=caf\\u00e9",
+            "list = a,\\\n    b\nkey\\ one=x\nu=caf\\u00e9",
+        },
+    }
+    f := func(in string) string {
+        obj, err := properties_codec{}.decode([]byte(in))
+        if err != nil {
+            return err.Error()
+        }
+        flattened, _ := flatten(obj, nil)
+        b, err := encode_file(flattened, properties_codec{}.read_layout([]byte(in)), properties_codec{})
+        if err != nil {
+            return err.Error()
+        }
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestPropertiesDecode(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "values": {
+            "a=1\nb : two words\nc\\=d=e\n  f\tg\nh=\\t\\u0041\\\\\nlist=a,\\\n   b",
+            `{"a":"1","b":"two words","c=d":"e","f":"g","h":"\tA\\","list":"a,b"}`,
+        },
+        "dots_stay_flat": {
+            "a.b.c=1\na.b=2",
+            `{"a.b":"2","a.b.c":"1"}`,
+        },
+        "empty_value": {
+            "a=\nb",
+            `{"a":"","b":""}`,
+        },
+        "bad_unicode": {
+            "a=1\nb=\\u00zz",
+            `:2: malformed \u escape "\\u00zz"`,
+        },
+    }
+    f := func(in string) string {
+        obj, err := properties_codec{}.decode([]byte(in))
+        if err != nil {
+            return properties_codec{}.decode_error("", []byte(in), err).Error()
+        }
+        b, _ := json.Marshal(obj)
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestPropertiesEntry(t * testing.T) {
+    testCases := map[string]testCaseTwoArgs[string, string, string]{
+        "plain": {"a.b", "1", "a.b=1"},
+        "key_escapes": {"a b:c=d", "x", "a\\ b\\:c\\=d=x"},
+        "value_escapes": {"k", " lead\nline\\", "k=\\ lead\\nline\\\\"},
+        "comment_char_key": {"#k", "x", "\\#k=x"},
+    }
+    f := func(key string, value string) string {
+        return properties_entry(key, value, style{}, false)
+    }
+    runTestsTwoArgsParallel[string, string, string](t, f, testCases)
+}
@@ -0,0 +1,221 @@
+package carver
+
+import (
+    "errors"
+    "io/fs"
+    "path"
+    "sort"
+    "strings"
+)
+
+// manifest_name is the file in an output directory that lists the files
+// carver wrote there. only files in the manifest are ever pruned, so files
+// written by hand are never touched.
+const manifest_name = ".carver-manifest"
+
+const manifest_header = "# files written by carver, which carver -prune deletes once it stops writing them\n"
+
+// the files after common_header are the common files of a normalized dir,
+// which merge reads into every env
+const common_header = "# common files, which merge copies into every env\n"
+
+// the files after stale_header are stale: carver wrote them before but no
+// longer does, and keeps them until they're pruned
+const stale_header = "# stale files, which carver no longer writes\n"
+
+// a commit collects the changes of a run for a sink
+type commit struct {
+    files map[string][]byte
+    removed []string
+}
+
+func (c * commit) write(name string, b []byte) {
+    c.files[name] = b
+}
+
+func (c * commit) remove(name string) {
+    c.removed = append(c.removed, name)
+}
+
+// a manifest lists all the files carver owns in a sink, and among them the
+// common files and the stale ones
+type manifest struct {
+    names map[string]bool
+    common map[string]bool
+    stale map[string]bool
+}
+
+func new_manifest() manifest {
+    return manifest{map[string]bool{}, map[string]bool{}, map[string]bool{}}
+}
+
+// read_manifest reads the manifest of a sink. a sink carver hasn't written to
+// has an empty one.
+func read_manifest(sink Sink) (manifest, error) {
+    b, err := sink.ReadFile(manifest_name)
+    if errors.Is(err, fs.ErrNotExist) {
+        return new_manifest(), nil
+    }
+    if err != nil {
+        return new_manifest(), err
+    }
+    return parse_manifest(b), nil
+}
+
+// read_root_manifest reads the manifest of a normalized dir like
+// read_manifest. a root without a manifest has an empty one.
+func read_root_manifest(r root) manifest {
+    b, err := r.read_file(manifest_name)
+    if err != nil {
+        return new_manifest()
+    }
+    return parse_manifest(b)
+}
+
+func parse_manifest(b []byte) manifest {
+    m := new_manifest()
+    section := m.names
+    for _, line := range strings.Split(string(b), "\n") {
+        line = strings.TrimSpace(line)
+        switch line {
+        case strings.TrimSpace(common_header):
+            section = m.common
+        case strings.TrimSpace(stale_header):
+            section = m.stale
+        }
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        m.names[path.Clean(line)] = true
+        section[path.Clean(line)] = true
+    }
+    return m
+}
+
+// manifest_names sorts the names of a manifest
+func manifest_names(names map[string]bool) []string {
+    sorted := []string{}
+    for name := range names {
+        sorted = append(sorted, name)
+    }
+    sort.Strings(sorted)
+    return sorted
+}
+
+// text lists the files of the manifest, the common and the stale ones in
+// sections of their own
+func (m manifest) text() []byte {
+    var sb strings.Builder
+    sb.WriteString(manifest_header)
+    sections := []struct {
+        header string
+        names map[string]bool
+    }{{"", map[string]bool{}}, {common_header, map[string]bool{}}, {stale_header, map[string]bool{}}}
+    for name := range m.names {
+        switch {
+        case m.stale[name]:
+            sections[2].names[name] = true
+        case m.common[name]:
+            sections[1].names[name] = true
+        default:
+            sections[0].names[name] = true
+        }
+    }
+    for _, s := range sections {
+        if len(s.names) > 0 {
+            sb.WriteString(s.header)
+        }
+        for _, name := range manifest_names(s.names) {
+            sb.WriteString(name + "\n")
+        }
+    }
+    return []byte(sb.String())
+}
+
+// stale_files lists the files of the manifest that the sink still holds but
+// that this run doesn't write
+func stale_files(sink Sink, manifest map[string]bool, names map[string]bool) []string {
+    stale := []string{}
+    for name := range manifest {
+        if names[name] {
+            continue
+        }
+        if _, err := sink.ReadFile(name); err == nil {
+            stale = append(stale, name)
+        }
+    }
+    sort.Strings(stale)
+    return stale
+}
+
+// update_manifest adds the changes plan_manifest plans to a commit: the
+// removal of the stale files when pruning, and the manifest when it changes
+func update_manifest(c * commit, sink Sink, output_dir string, names map[string]bool, common map[string]bool, prune bool, complete bool) (Report, error) {
+    report, err := plan_manifest(sink, output_dir, names, common, prune, complete)
+    for _, change := range report {
+        switch {
+        case change.Action == change_deleted:
+            c.remove(change.name)
+        case change.changed():
+            c.write(change.name, change.new)
+        }
+    }
+    return report, err
+}
+
+// plan_manifest lists the files carver wrote to the sink last time but doesn't
+// write now, as deleted when pruning and as stale otherwise, along with the
+// manifest of the files it writes, with the common ones among them. when the
+// run is incomplete, because some files couldn't be read, nothing is stale,
+// since the files of the groups that were skipped would look stale.
+func plan_manifest(sink Sink, output_dir string, names map[string]bool, common map[string]bool, prune bool, complete bool) (Report, error) {
+    stale := Report{}
+    old, err := read_manifest(sink)
+    if err != nil {
+        return stale, err
+    }
+    m := new_manifest()
+    for name := range names {
+        m.names[name] = true
+        m.common[name] = common[name]
+    }
+    if !complete {
+        for name := range old.names {
+            if !names[name] {
+                m.names[name] = true
+                m.common[name] = old.common[name]
+                m.stale[name] = old.stale[name]
+            }
+        }
+    } else {
+        stale, err = plan_stale(sink, output_dir, old.names, names, prune)
+    }
+    for _, change := range stale {
+        // files that are kept stay in the manifest until they're pruned
+        if change.Action != change_deleted {
+            m.names[change.name] = true
+            m.stale[change.name] = true
+        }
+    }
+    file_path := path.Clean(output_dir + "/" + manifest_name)
+    return append(stale, new_change(sink, manifest_name, file_path, m.text())), err
+}
+
+// plan_stale lists the files of the manifest that this run doesn't write, as
+// deleted when pruning and as stale otherwise
+func plan_stale(sink Sink, output_dir string, manifest map[string]bool, names map[string]bool, prune bool) (Report, error) {
+    stale := Report{}
+    for _, name := range stale_files(sink, manifest, names) {
+        file_path := path.Clean(output_dir + "/" + name)
+        if !prune {
+            stale = append(stale, FileChange{Path: file_path, Action: change_stale, name: name})
+            continue
+        }
+        old, err := sink.ReadFile(name)
+        if err != nil {
+            return stale, err
+        }
+        stale = append(stale, FileChange{file_path, change_deleted, name, old, []byte{}})
+    }
+    return stale, nil
+}
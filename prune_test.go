@@ -0,0 +1,127 @@
+package carver
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestReadManifest(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, []string]{
+        "empty": {"", []string{}},
+        "header": {manifest_header + "a.json\nb/c.yaml\n", []string{"a.json", "b/c.yaml"}},
+        "blank lines": {"\na.json\n\n# a comment\n./b.json\n", []string{"a.json", "b.json"}},
+    }
+    f := func(content string) []string {
+        dir := t.TempDir()
+        os.WriteFile(filepath.Join(dir, manifest_name), []byte(content), 0666)
+        m, _ := read_manifest(DiskSink(dir))
+        return manifest_names(m.names)
+    }
+    runTestsOneArgParallel[string, []string](t, f, testCases)
+}
+
+func TestManifestSections(t * testing.T) {
+    type result struct {
+        Common []string
+        Stale []string
+    }
+    testCases := map[string]testCaseOneArg[string, result]{
+        "none": {manifest_header + "a.json\n", result{[]string{}, []string{}}},
+        "stale": {
+            manifest_header + "a.json\n" + stale_header + "prod/a.json\n",
+            result{[]string{}, []string{"prod/a.json"}},
+        },
+        "common": {
+            manifest_header + "dev/a.json\n" + common_header + "a.json\nsub/b.json\n" + stale_header + "prod/a.json\n",
+            result{[]string{"a.json", "sub/b.json"}, []string{"prod/a.json"}},
+        },
+    }
+    f := func(content string) result {
+        m := parse_manifest([]byte(content))
+        if string(m.text()) != content {
+            return result{[]string{"rewritten as " + string(m.text())}, nil}
+        }
+        return result{manifest_names(m.common), manifest_names(m.stale)}
+    }
+    runTestsOneArgParallel[string, result](t, f, testCases)
+}
+
+func TestUpdateManifest(t * testing.T) {
+    type result struct {
+        Files []string
+        Manifest []string
+        Actions []string
+    }
+    testCases := map[string]testCaseTwoArgs[bool, bool, result]{
+        "report": {false, true, result{
+            []string{"a.json", "hand.json", "old/b.json"},
+            []string{"a.json", "old/b.json"},
+            []string{change_stale, change_updated},
+        }},
+        "prune": {true, true, result{
+            []string{"a.json", "hand.json"},
+            []string{"a.json"},
+            []string{change_deleted, change_updated},
+        }},
+        "incomplete": {true, false, result{
+            []string{"a.json", "hand.json", "old/b.json"},
+            []string{"a.json", "old/b.json"},
+            []string{change_unchanged},
+        }},
+    }
+    f := func(prune bool, complete bool) result {
+        dir := t.TempDir()
+        os.MkdirAll(filepath.Join(dir, "old"), 0750)
+        for _, name := range []string{"a.json", "hand.json", "old/b.json"} {
+            os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0666)
+        }
+        sink := DiskSink(dir)
+        c := commit{map[string][]byte{}, []string{}}
+        update_manifest(&c, sink, dir, map[string]bool{"a.json": true, "old/b.json": true}, nil, false, true)
+        sink.Commit(c.files, c.removed)
+        c = commit{map[string][]byte{}, []string{}}
+        stale, _ := update_manifest(&c, sink, dir, map[string]bool{"a.json": true}, nil, prune, complete)
+        sink.Commit(c.files, c.removed)
+        files := []string{}
+        filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+            if !info.IsDir() && info.Name() != manifest_name {
+                rel, _ := filepath.Rel(dir, p)
+                files = append(files, filepath.ToSlash(rel))
+            }
+            return nil
+        })
+        m, _ := read_manifest(sink)
+        actions := []string{}
+        for _, c := range stale {
+            actions = append(actions, c.Action)
+        }
+        return result{files, manifest_names(m.names), actions}
+    }
+    runTestsTwoArgsParallel[bool, bool, result](t, f, testCases)
+}
+
+func TestPruneEmptyDirs(t * testing.T) {
+    dir := t.TempDir()
+    os.MkdirAll(filepath.Join(dir, "a", "b"), 0750)
+    os.MkdirAll(filepath.Join(dir, "c"), 0750)
+    os.WriteFile(filepath.Join(dir, "a", "b", "x.json"), []byte("{}\n"), 0666)
+    os.WriteFile(filepath.Join(dir, "c", "x.json"), []byte("{}\n"), 0666)
+    os.WriteFile(filepath.Join(dir, "c", "hand.json"), []byte("{}\n"), 0666)
+    tx := transaction{}
+    tx.remove(dir, filepath.Join(dir, "a", "b", "x.json"))
+    tx.remove(dir, filepath.Join(dir, "c", "x.json"))
+    err := tx.commit()
+    if err != nil {
+        t.Fatal(err)
+    }
+    exists := func(name string) bool {
+        _, err := os.Stat(filepath.Join(dir, name))
+        return err == nil
+    }
+    got := []bool{exists("a"), exists("c"), exists("c/hand.json")}
+    if !reflect.DeepEqual(got, []bool{false, true, true}) {
+        t.Errorf(`expected a to be removed and c kept, got %v`, got)
+    }
+}
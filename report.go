@@ -0,0 +1,96 @@
+package carver
+
+import (
+    "encoding/json"
+    "sort"
+    "strings"
+)
+
+// the actions of a FileChange
+const (
+    change_generated = "generated"
+    change_updated = "updated"
+    change_unchanged = "unchanged"
+    change_deleted = "deleted"
+    // a stale file is one carver wrote before but no longer writes, which is
+    // kept until it's pruned
+    change_stale = "stale"
+)
+
+// a FileChange is what a run did to a file, or would do on a dry run: its
+// Action is generated, updated, unchanged, deleted or stale
+type FileChange struct {
+    Path string `json:"path"`
+    Action string `json:"action"`
+    // name is the path of the file in its sink
+    name string
+    old []byte
+    new []byte
+}
+
+// a Report lists the files of a run by path
+type Report []FileChange
+
+// new_change compares the contents a file should have with the ones the sink
+// holds
+func new_change(sink Sink, name string, file_path string, b []byte) FileChange {
+    old, err := sink.ReadFile(name)
+    switch {
+    case err != nil:
+        return FileChange{file_path, change_generated, name, nil, b}
+    case string(old) == string(b):
+        return FileChange{file_path, change_unchanged, name, old, b}
+    }
+    return FileChange{file_path, change_updated, name, old, b}
+}
+
+// changed reports whether the file has to be written
+func (c FileChange) changed() bool {
+    return c.Action == change_generated || c.Action == change_updated
+}
+
+func (c FileChange) diff() string {
+    old_name := c.Path
+    new_name := c.Path
+    switch c.Action {
+    case change_generated:
+        old_name = "/dev/null"
+    case change_deleted:
+        new_name = "/dev/null"
+    }
+    return unified_diff(old_name, new_name, c.old, c.new)
+}
+
+func (r Report) sort() {
+    sort.SliceStable(r, func(i, j int) bool {
+        return r[i].Path < r[j].Path
+    })
+}
+
+// Text describes each file on a line, e.g. "Updated .carver/dev/app.json"
+func (r Report) Text() string {
+    var sb strings.Builder
+    for _, c := range r {
+        sb.WriteString(strings.ToUpper(c.Action[:1]) + c.Action[1:] + " " + c.Path + "\n")
+    }
+    return sb.String()
+}
+
+// Diff is a unified diff of the changes
+func (r Report) Diff() string {
+    var sb strings.Builder
+    for _, c := range r {
+        sb.WriteString(c.diff())
+    }
+    return sb.String()
+}
+
+// JSON is the report as a json object with a list of files
+func (r Report) JSON() string {
+    files := r
+    if files == nil {
+        files = Report{}
+    }
+    b, _ := json.MarshalIndent(map[string]Report{"files": files}, "", "    ")
+    return string(b) + "\n"
+}
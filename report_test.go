@@ -0,0 +1,96 @@
+package carver
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestNewChange(t * testing.T) {
+    dir := t.TempDir()
+    os.WriteFile(filepath.Join(dir, "a.json"), []byte("{}\n"), 0666)
+    testCases := map[string]testCaseTwoArgs[string, string, string]{
+        "generated": {"b.json", "{}\n", change_generated},
+        "updated": {"a.json", "{\"x\": 1}\n", change_updated},
+        "unchanged": {"a.json", "{}\n", change_unchanged},
+    }
+    f := func(name string, content string) string {
+        return new_change(DiskSink(dir), name, filepath.Join(dir, name), []byte(content)).Action
+    }
+    runTestsTwoArgsParallel[string, string, string](t, f, testCases)
+}
+
+func TestReportFormat(t * testing.T) {
+    report := Report{
+        {".carver/a.json", change_generated, "a.json", nil, []byte("{}\n")},
+        {".carver/b.json", change_unchanged, "b.json", []byte("{}\n"), []byte("{}\n")},
+        {".carver/c.json", change_deleted, "c.json", []byte("{}\n"), []byte{}},
+        {".carver/d.json", change_stale, "d.json", nil, nil},
+    }
+    testCases := map[string]testCaseOneArg[func() string, string]{
+        "text": {
+            report.Text,
+            "Generated .carver/a.json\nUnchanged .carver/b.json\nDeleted .carver/c.json\nStale .carver/d.json\n",
+        },
+        "diff": {
+            report.Diff,
+            "--- /dev/null\n+++ .carver/a.json\n@@ -0,0 +1 @@\n+{}\n--- .carver/c.json\n+++ /dev/null\n@@ -1 +0,0 @@\n-{}\n",
+        },
+        "json": {
+            report[:3].JSON,
+            `{
+    "files": [
+        {
+            "path": ".carver/a.json",
+            "action": "generated"
+        },
+        {
+            "path": ".carver/b.json",
+            "action": "unchanged"
+        },
+        {
+            "path": ".carver/c.json",
+            "action": "deleted"
+        }
+    ]
+}
+`,
+        },
+        "empty json": {
+            Report(nil).JSON,
+            "{\n    \"files\": []\n}\n",
+        },
+    }
+    f := func(format func() string) string {
+        return format()
+    }
+    runTestsOneArgParallel[func() string, string](t, f, testCases)
+}
+
+func TestWriteFilesSkipsUnchanged(t * testing.T) {
+    dir := t.TempDir()
+    filenames := map[string]map[string]interface{}{
+        "a.json": {"/x": "1"},
+        "b.json": {"/x": "2"},
+    }
+    write_or_diff(DiskSink(dir), dir, filenames, map[string]layout{}, nil, nil, false, false, true)
+    past := time.Now().Add(-time.Hour).Truncate(time.Second)
+    os.Chtimes(filepath.Join(dir, "a.json"), past, past)
+    os.Chtimes(filepath.Join(dir, manifest_name), past, past)
+    filenames["b.json"] = map[string]interface{}{"/x": "3"}
+    report, err := write_or_diff(DiskSink(dir), dir, filenames, map[string]layout{}, nil, nil, false, false, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    actions := []string{report[0].Action, report[1].Action, report[2].Action}
+    if actions[0] != change_unchanged || actions[1] != change_unchanged || actions[2] != change_updated {
+        t.Errorf(`expected the manifest and a.json unchanged and b.json updated, got %v`, actions)
+    }
+    for _, name := range []string{manifest_name, "a.json"} {
+        info, _ := os.Stat(filepath.Join(dir, name))
+        if !info.ModTime().Equal(past) {
+            t.Errorf(`expected %s to keep its modification time, got %v`, name, info.ModTime())
+        }
+    }
+}
@@ -0,0 +1,167 @@
+package carver
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+// a Sink receives the files of a run, named by slash-separated paths like
+// "dev/app.json". it reads the files it already holds, which keep their
+// layouts and tell which files changed, and it commits the changes of a run
+// all at once.
+type Sink interface {
+    // ReadFile reads a file the sink holds, with an error matching
+    // fs.ErrNotExist when it has none
+    ReadFile(name string) ([]byte, error)
+    // Commit writes the files and removes the ones in removed
+    Commit(files map[string][]byte, removed []string) error
+}
+
+// a disk_sink writes to a directory in one transaction
+type disk_sink struct {
+    dir string
+}
+
+// DiskSink writes the files of a run to a directory, all at once or not at
+// all
+func DiskSink(dir string) Sink {
+    return disk_sink{dir}
+}
+
+func (s disk_sink) ReadFile(name string) ([]byte, error) {
+    return os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+func (s disk_sink) Commit(files map[string][]byte, removed []string) error {
+    t := transaction{}
+    errs := error_list{}
+    for _, name := range sorted_names(files) {
+        errs = errs.add(t.write(filepath.Join(s.dir, filepath.FromSlash(name)), files[name]))
+    }
+    for _, name := range removed {
+        t.remove(s.dir, filepath.Join(s.dir, filepath.FromSlash(name)))
+    }
+    if len(errs) > 0 {
+        t.abort()
+        return errs.err()
+    }
+    return t.commit()
+}
+
+// a MemorySink holds the files of its runs in memory
+type MemorySink struct {
+    Files map[string][]byte
+}
+
+// NewMemorySink returns a MemorySink that holds no files yet
+func NewMemorySink() * MemorySink {
+    return &MemorySink{map[string][]byte{}}
+}
+
+// ReadFile returns the contents of a file the sink holds
+func (s * MemorySink) ReadFile(name string) ([]byte, error) {
+    b, ok := s.Files[name]
+    if !ok {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+    }
+    return b, nil
+}
+
+// Commit stores the files and drops the removed ones. it never fails.
+func (s * MemorySink) Commit(files map[string][]byte, removed []string) error {
+    for name, b := range files {
+        s.Files[name] = b
+    }
+    for _, name := range removed {
+        delete(s.Files, name)
+    }
+    return nil
+}
+
+// an archive_sink writes the files of a run to a new tar or zip archive,
+// which holds nothing before, so every file is generated
+type archive_sink struct {
+    w io.Writer
+    format string
+}
+
+// TarSink writes the files of a run to a tar archive
+func TarSink(w io.Writer) Sink {
+    return archive_sink{w, "tar"}
+}
+
+// ZipSink writes the files of a run to a zip archive
+func ZipSink(w io.Writer) Sink {
+    return archive_sink{w, "zip"}
+}
+
+func (s archive_sink) ReadFile(name string) ([]byte, error) {
+    return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (s archive_sink) Commit(files map[string][]byte, removed []string) error {
+    // files are stamped with a fixed time, so the same files make the same
+    // archive
+    mod_time := time.Unix(0, 0).UTC()
+    if s.format == "zip" {
+        zw := zip.NewWriter(s.w)
+        for _, name := range sorted_names(files) {
+            w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mod_time})
+            if err == nil {
+                _, err = w.Write(files[name])
+            }
+            if err != nil {
+                return err
+            }
+        }
+        return zw.Close()
+    }
+    tw := tar.NewWriter(s.w)
+    dirs := map[string]bool{}
+    for _, name := range sorted_names(files) {
+        for _, dir := range parent_dirs(name) {
+            if dirs[dir] {
+                continue
+            }
+            dirs[dir] = true
+            err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: mod_time})
+            if err != nil {
+                return err
+            }
+        }
+        err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: mod_time})
+        if err == nil {
+            _, err = tw.Write(files[name])
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return tw.Close()
+}
+
+// parent_dirs lists the directories above a file from the top, e.g. a and a/b
+// for a/b/c.json
+func parent_dirs(name string) []string {
+    dirs := []string{}
+    for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+        dirs = append([]string{dir}, dirs...)
+    }
+    return dirs
+}
+
+func sorted_names(files map[string][]byte) []string {
+    names := []string{}
+    for name := range files {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
@@ -0,0 +1,75 @@
+package carver
+
+import (
+    "archive/zip"
+    "bytes"
+    "errors"
+    "io/fs"
+    "testing"
+)
+
+// fs_contents lists the files of a file system with their contents
+func fs_contents(fsys fs.FS) map[string]string {
+    contents := map[string]string{}
+    fs.WalkDir(fsys, ".", func(p string, e fs.DirEntry, err error) error {
+        if err == nil && !e.IsDir() {
+            b, _ := fs.ReadFile(fsys, p)
+            contents[p] = string(b)
+        }
+        return err
+    })
+    return contents
+}
+
+func TestMemorySink(t * testing.T) {
+    sink := NewMemorySink()
+    sink.Commit(map[string][]byte{"a.json": []byte("a"), "b/c.json": []byte("c")}, nil)
+    sink.Commit(map[string][]byte{"a.json": []byte("new")}, []string{"b/c.json"})
+    b, err := sink.ReadFile("a.json")
+    if err != nil || string(b) != "new" {
+        t.Fatalf(`expected a.json to be rewritten, got %q (%v)`, b, err)
+    }
+    _, err = sink.ReadFile("b/c.json")
+    if !errors.Is(err, fs.ErrNotExist) {
+        t.Fatalf(`expected b/c.json to be removed, got %v`, err)
+    }
+}
+
+func TestArchiveSinks(t * testing.T) {
+    files := map[string][]byte{"a.json": []byte("a"), "b/c/d.json": []byte("d")}
+    expected := map[string]string{"a.json": "a", "b/c/d.json": "d"}
+    testCases := map[string]testCaseOneArg[string, map[string]string]{
+        "tar": {"tar", expected},
+        "zip": {"zip", expected},
+    }
+    f := func(format string) map[string]string {
+        var buf bytes.Buffer
+        sink := TarSink(&buf)
+        if format == "zip" {
+            sink = ZipSink(&buf)
+        }
+        err := sink.Commit(files, nil)
+        if err != nil {
+            return nil
+        }
+        var fsys fs.FS
+        if format == "zip" {
+            fsys, err = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+        } else {
+            fsys, err = TarFS(&buf)
+        }
+        if err != nil {
+            return nil
+        }
+        return fs_contents(fsys)
+    }
+    runTestsOneArgParallel[string, map[string]string](t, f, testCases)
+}
+
+func TestParentDirs(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, []string]{
+        "top": {"a.json", []string{}},
+        "nested": {"a/b/c.json", []string{"a", "a/b"}},
+    }
+    runTestsOneArgParallel[string, []string](t, parent_dirs, testCases)
+}
@@ -0,0 +1,609 @@
+package carver
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+    "encoding/json"
+    "github.com/BurntSushi/toml"
+)
+
+// a datetime is a toml date, time or datetime, kept as the text it's written
+// as. other formats write it as a string.
+type datetime string
+
+func (d datetime) MarshalJSON() ([]byte, error) {
+    return json.Marshal(string(d))
+}
+
+// decode_toml decodes a toml document into the same shape as json, with
+// numbers as json.Number. floats keep a fraction or exponent, so they stay
+// floats when they're written back.
+func decode_toml(b []byte) (map[string]interface{}, error) {
+    var doc map[string]interface{}
+    _, err := toml.Decode(string(b), &doc)
+    if err != nil {
+        return map[string]interface{}{}, err
+    }
+    v, err := toml_value(doc)
+    if err != nil {
+        return map[string]interface{}{}, err
+    }
+    return v.(map[string]interface{}), nil
+}
+
+func toml_value(v interface{}) (interface{}, error) {
+    switch vv := v.(type) {
+    case map[string]interface{}:
+        obj := map[string]interface{}{}
+        for k, c := range vv {
+            value, err := toml_value(c)
+            if err != nil {
+                return nil, err
+            }
+            obj[k] = value
+        }
+        return obj, nil
+    case []map[string]interface{}:
+        items := []interface{}{}
+        for _, c := range vv {
+            value, err := toml_value(c)
+            if err != nil {
+                return nil, err
+            }
+            items = append(items, value)
+        }
+        return items, nil
+    case []interface{}:
+        items := []interface{}{}
+        for _, c := range vv {
+            value, err := toml_value(c)
+            if err != nil {
+                return nil, err
+            }
+            items = append(items, value)
+        }
+        return items, nil
+    case int64:
+        return json.Number(strconv.FormatInt(vv, 10)), nil
+    case float64:
+        if math.IsInf(vv, 0) || math.IsNaN(vv) {
+            return nil, fmt.Errorf("%v can't be carried as a number", vv)
+        }
+        s := strconv.FormatFloat(vv, 'g', -1, 64)
+        if !strings.ContainsAny(s, ".e") {
+            s += ".0"
+        }
+        return json.Number(s), nil
+    case time.Time:
+        // the decoder marks local dates and times with these zones
+        switch vv.Location().String() {
+        case "date-local":
+            return datetime(vv.Format("2006-01-02")), nil
+        case "time-local":
+            return datetime(vv.Format("15:04:05.999999999")), nil
+        case "datetime-local":
+            return datetime(vv.Format("2006-01-02T15:04:05.999999999")), nil
+        }
+        return datetime(vv.Format(time.RFC3339Nano)), nil
+    }
+    return v, nil
+}
+
+// toml_decode_error places a toml syntax error of the file at path
+func toml_decode_error(path string, b []byte, err error) error {
+    var parse_err toml.ParseError
+    if !errors.As(err, &parse_err) {
+        return file_error{path, 0, 0, err}
+    }
+    pos := parse_err.Position
+    col := 0
+    if pos.Start <= len(b) {
+        col = pos.Start - strings.LastIndex(string(b[:pos.Start]), "\n")
+    }
+    msg := toml_line.ReplaceAllString(parse_err.Error(), "")
+    return file_error{path, pos.Line, col, errors.New(msg)}
+}
+
+var toml_line = regexp.MustCompile(`^toml: line \d+( \(last key ".*"\))?: `)
+
+type toml_codec struct{}
+
+func (toml_codec) name() string {
+    return "toml"
+}
+
+func (toml_codec) exts() []string {
+    return []string{".toml"}
+}
+
+func (toml_codec) sniff(b []byte) bool {
+    var doc map[string]interface{}
+    _, err := toml.Decode(string(b), &doc)
+    return err == nil && len(doc) > 0
+}
+
+func (toml_codec) decode(b []byte) (map[string]interface{}, error) {
+    return decode_toml(b)
+}
+
+func (toml_codec) decode_error(path string, b []byte, err error) error {
+    return toml_decode_error(path, b, err)
+}
+
+func (toml_codec) read_layout(b []byte) layout {
+    return toml_layout(b)
+}
+
+func (toml_codec) default_layout() layout {
+    return new_layout("toml", true)
+}
+
+func (toml_codec) encode(doc *doc_node, l layout) ([]byte, error) {
+    return encode_toml(doc, l)
+}
+
+// toml_layout reads the key order of a toml document, the tables that are
+// written inline and its comments
+func toml_layout(b []byte) layout {
+    l := new_layout("toml", true)
+    var doc map[string]interface{}
+    md, err := toml.Decode(string(b), &doc)
+    if err != nil {
+        return l
+    }
+    l.known = true
+    l.comments, l.tight_headers = toml_comments(b)
+    headers := toml_headers(b)
+    counts := map[string]int{}
+    for _, key := range md.Keys() {
+        p := ""
+        for i := range key {
+            p = join_path(p, key[i])
+            if md.Type(key[:i+1]...) != "ArrayHash" {
+                continue
+            }
+            if i == len(key) - 1 {
+                counts[p]++
+            }
+            p = join_path(p, strconv.Itoa(counts[p] - 1))
+        }
+        switch md.Type(key...) {
+        case "ArrayHash":
+        case "Hash":
+            name := strings.Join(key, ".")
+            if !headers[name] && !toml_has_subheader(headers, name) {
+                l.inline[p] = true
+            }
+            if v, ok := toml_lookup(doc, key); ok && len(v) == 0 {
+                l.order = append(l.order, p)
+            }
+        case "Array":
+            l.order = append(l.order, value_order(p, toml_array(doc, key))...)
+        default:
+            l.order = append(l.order, p)
+        }
+    }
+    return l
+}
+
+func toml_lookup(doc map[string]interface{}, key toml.Key) (map[string]interface{}, bool) {
+    var v interface{} = doc
+    for _, k := range key {
+        obj, ok := v.(map[string]interface{})
+        if !ok {
+            return nil, false
+        }
+        v = obj[k]
+    }
+    obj, ok := v.(map[string]interface{})
+    return obj, ok
+}
+
+func toml_array(doc map[string]interface{}, key toml.Key) interface{} {
+    parent, ok := toml_lookup(doc, key[:len(key)-1])
+    if !ok {
+        return nil
+    }
+    return parent[key[len(key)-1]]
+}
+
+// value_order lists the flattened keys of a decoded value in order, with the
+// keys of objects sorted
+func value_order(prefix string, v interface{}) []string {
+    order := []string{}
+    switch vv := v.(type) {
+    case map[string]interface{}:
+        for _, k := range order_keys(vv, []string{}) {
+            order = append(order, value_order(join_path(prefix, k), vv[k])...)
+        }
+        if len(vv) == 0 {
+            order = append(order, prefix)
+        }
+    case []interface{}:
+        for i, c := range vv {
+            order = append(order, value_order(join_path(prefix, strconv.Itoa(i)), c)...)
+        }
+        if len(vv) == 0 {
+            order = append(order, prefix)
+        }
+    default:
+        order = append(order, prefix)
+    }
+    return order
+}
+
+// a toml_stmt is a statement of a toml document, a key or a table header,
+// along with the comment at its end. a value may span several lines.
+type toml_stmt struct {
+    code string
+    comment string
+}
+
+// toml_statements splits a toml document into statements. comments inside arrays
+// that span several lines are dropped.
+func toml_statements(b []byte) []toml_stmt {
+    lines := []toml_stmt{}
+    var code strings.Builder
+    comment := ""
+    depth := 0
+    s := string(b)
+    for i := 0; i < len(s); i++ {
+        ch := s[i]
+        switch {
+        case strings.HasPrefix(s[i:], `"""`) || strings.HasPrefix(s[i:], "'''"):
+            end := toml_string_end(s, i + 3, s[i:i+3])
+            code.WriteString(s[i:end])
+            i = end - 1
+        case ch == '"' || ch == '\'':
+            end := toml_string_end(s, i + 1, s[i:i+1])
+            code.WriteString(s[i:end])
+            i = end - 1
+        case ch == '#':
+            end := strings.IndexByte(s[i:], '\n')
+            if end < 0 {
+                end = len(s) - i
+            }
+            if depth == 0 {
+                comment = strings.TrimRight(s[i:i+end], "\r")
+            }
+            i += end - 1
+        case ch == '\n' && depth == 0:
+            lines = append(lines, toml_stmt{strings.TrimSpace(code.String()), comment})
+            code.Reset()
+            comment = ""
+        default:
+            switch ch {
+            case '[', '{':
+                depth++
+            case ']', '}':
+                if depth > 0 {
+                    depth--
+                }
+            }
+            code.WriteByte(ch)
+        }
+    }
+    if strings.TrimSpace(code.String()) != "" || comment != "" {
+        lines = append(lines, toml_stmt{strings.TrimSpace(code.String()), comment})
+    }
+    return lines
+}
+
+// toml_string_end finds the end of a string that starts before i, just past
+// its closing quote
+func toml_string_end(s string, i int, quote string) int {
+    for ; i < len(s); i++ {
+        if s[i] == '\\' && quote[0] == '"' {
+            i++
+            continue
+        }
+        if strings.HasPrefix(s[i:], quote) {
+            return i + len(quote)
+        }
+    }
+    return len(s)
+}
+
+// toml_comments places the comments of a toml document on the keys and
+// tables they belong to: the comment lines above a key or a header and the
+// comment after it. comments above the first key that a blank line separates
+// from it belong to the document, as do the comments after the last key. it
+// also returns the tables whose header has no blank line above it.
+func toml_comments(b []byte) (map[string]comment, map[string]bool) {
+    comments := map[string]comment{}
+    tight := map[string]bool{}
+    table := ""
+    // the number of items of each array of tables so far
+    items := map[string]int{}
+    resolve := func(keys []string) string {
+        p := ""
+        for _, k := range keys {
+            p = join_path(p, k)
+            if n, ok := items[p]; ok {
+                p = join_path(p, strconv.Itoa(n - 1))
+            }
+        }
+        return p
+    }
+    // the comment lines waiting for a key, with "" for a blank line
+    head := []string{}
+    seen := false
+    for _, line := range toml_statements(b) {
+        if line.code == "" {
+            if line.comment != "" {
+                head = append(head, line.comment)
+            } else if len(head) == 0 || head[len(head)-1] != "" {
+                head = append(head, "")
+            }
+            continue
+        }
+        tight_above := len(head) == 0 || head[0] != ""
+        head = trim_blank_lines(head)
+        if !seen {
+            seen = true
+            for i := len(head) - 1; i >= 0; i-- {
+                if head[i] == "" {
+                    comments[""] = comment{head: strings.Join(trim_blank_lines(head[:i]), "\n")}
+                    head = head[i+1:]
+                    break
+                }
+            }
+        }
+        var p string
+        switch {
+        case strings.HasPrefix(line.code, "[["):
+            keys := toml_split_key(strings.TrimSuffix(strings.TrimPrefix(line.code, "[["), "]]"))
+            p = join_path(resolve(keys[:len(keys)-1]), keys[len(keys)-1])
+            items[p]++
+            p = join_path(p, strconv.Itoa(items[p] - 1))
+            table = p
+            if tight_above {
+                tight[p] = true
+            }
+        case strings.HasPrefix(line.code, "["):
+            table = resolve(toml_split_key(strings.TrimSuffix(strings.TrimPrefix(line.code, "["), "]")))
+            p = table
+            if tight_above {
+                tight[p] = true
+            }
+        default:
+            p = table
+            for _, k := range toml_split_key(toml_key_text(line.code)) {
+                p = join_path(p, k)
+            }
+        }
+        comments[p] = comment{strings.Join(head, "\n"), line.comment, ""}
+        head = []string{}
+    }
+    for len(head) > 0 && head[len(head)-1] == "" {
+        head = head[:len(head)-1]
+    }
+    if len(head) > 0 {
+        doc := comments[""]
+        doc.foot = strings.Join(head, "\n")
+        comments[""] = doc
+    }
+    return comments, tight
+}
+
+// trim_blank_lines drops the blank lines around comment lines
+func trim_blank_lines(lines []string) []string {
+    for len(lines) > 0 && lines[0] == "" {
+        lines = lines[1:]
+    }
+    for len(lines) > 0 && lines[len(lines)-1] == "" {
+        lines = lines[:len(lines)-1]
+    }
+    return lines
+}
+
+// toml_key_text is the key of a key = value line, before the = outside quotes
+func toml_key_text(code string) string {
+    quote := byte(0)
+    for i := 0; i < len(code); i++ {
+        ch := code[i]
+        switch {
+        case quote != 0 && ch == '\\' && quote == '"':
+            i++
+        case quote != 0 && ch == quote:
+            quote = 0
+        case quote != 0:
+        case ch == '"' || ch == '\'':
+            quote = ch
+        case ch == '=':
+            return code[:i]
+        }
+    }
+    return code
+}
+
+var toml_header = regexp.MustCompile(`^\s*\[\[?([^\]]*)\]\]?\s*(#.*)?$`)
+
+// toml_headers finds the tables that have a [header], by their dotted keys
+func toml_headers(b []byte) map[string]bool {
+    headers := map[string]bool{}
+    for _, line := range strings.Split(string(b), "\n") {
+        m := toml_header.FindStringSubmatch(line)
+        if m == nil {
+            continue
+        }
+        headers[strings.Join(toml_split_key(m[1]), ".")] = true
+    }
+    return headers
+}
+
+func toml_has_subheader(headers map[string]bool, name string) bool {
+    for h := range headers {
+        if strings.HasPrefix(h, name + ".") {
+            return true
+        }
+    }
+    return false
+}
+
+// toml_split_key splits a dotted key like a."b.c".d into its keys
+func toml_split_key(s string) []string {
+    keys := []string{}
+    var sb strings.Builder
+    quote := byte(0)
+    for i := 0; i < len(s); i++ {
+        ch := s[i]
+        switch {
+        case quote != 0 && ch == '\\' && quote == '"' && i+1 < len(s):
+            i++
+            sb.WriteByte(s[i])
+        case quote != 0 && ch == quote:
+            quote = 0
+        case quote != 0:
+            sb.WriteByte(ch)
+        case ch == '"' || ch == '\'':
+            quote = ch
+        case ch == '.':
+            keys = append(keys, sb.String())
+            sb.Reset()
+        case ch != ' ' && ch != '\t':
+            sb.WriteByte(ch)
+        }
+    }
+    return append(keys, sb.String())
+}
+
+var toml_bare_key = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func toml_key(k string) string {
+    if toml_bare_key.MatchString(k) {
+        return k
+    }
+    return json_scalar(k)
+}
+
+func toml_scalar(v interface{}) (string, error) {
+    switch vv := v.(type) {
+    case nil:
+        return "", fmt.Errorf("toml has no null")
+    case datetime:
+        return string(vv), nil
+    case map[string]interface{}:
+        return "{}", nil
+    case []interface{}:
+        return "[]", nil
+    }
+    return json_scalar(v), nil
+}
+
+// toml_inline writes a value on one line, e.g. [1, 2] or { a = 1 }
+func toml_inline(n *doc_node) (string, error) {
+    if n.leaf || n.is_empty() {
+        return toml_scalar(n.value)
+    }
+    items := []string{}
+    for _, c := range n.children {
+        item, err := toml_inline(c)
+        if err != nil {
+            return "", err
+        }
+        if !n.array {
+            item = toml_key(c.key) + " = " + item
+        }
+        items = append(items, item)
+    }
+    if n.array {
+        return "[" + strings.Join(items, ", ") + "]", nil
+    }
+    return "{ " + strings.Join(items, ", ") + " }", nil
+}
+
+func is_toml_table(n *doc_node, l layout) bool {
+    return !n.leaf && !n.is_empty() && !n.array && !l.inline[n.path]
+}
+
+func is_toml_table_array(n *doc_node, l layout) bool {
+    if !n.array || l.inline[n.path] {
+        return false
+    }
+    for _, c := range n.children {
+        if c.leaf || c.is_empty() || c.array {
+            return false
+        }
+    }
+    return true
+}
+
+func encode_toml(doc *doc_node, l layout) ([]byte, error) {
+    var sb strings.Builder
+    c := l.comments[""]
+    if c.head != "" {
+        write_comment(&sb, c.head, "")
+        sb.WriteString("\n")
+    }
+    err := encode_toml_table(&sb, doc, []string{}, l)
+    write_comment(&sb, c.foot, "")
+    return []byte(sb.String()), err
+}
+
+// encode_toml_table writes the values of a table and then its tables, since
+// toml puts every key of a table before the first table inside it. a table
+// that only holds other tables gets no header of its own.
+func encode_toml_table(sb *strings.Builder, n *doc_node, keys []string, l layout) error {
+    tables := []*doc_node{}
+    for _, c := range n.children {
+        if is_toml_table(c, l) || is_toml_table_array(c, l) {
+            tables = append(tables, c)
+            continue
+        }
+        value, err := toml_inline(c)
+        if err != nil {
+            return fmt.Errorf("%s: %s", c.path, err)
+        }
+        cm := l.comments[c.path]
+        write_comment(sb, cm.head, "")
+        sb.WriteString(line_comment(toml_key(c.key) + " = " + value, cm.line) + "\n")
+    }
+    for _, c := range tables {
+        c_keys := append(append([]string{}, keys...), toml_key(c.key))
+        name := strings.Join(c_keys, ".")
+        if c.array {
+            for _, item := range c.children {
+                toml_header_line(sb, "[[" + name + "]]", l.comments[item.path], l.tight_headers[item.path])
+                err := encode_toml_table(sb, item, c_keys, l)
+                if err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+        // a table that only holds other tables keeps a header with comments
+        if has_toml_values(c, l) || !l.comments[c.path].is_empty() {
+            toml_header_line(sb, "[" + name + "]", l.comments[c.path], l.tight_headers[c.path])
+        }
+        err := encode_toml_table(sb, c, c_keys, l)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func has_toml_values(n *doc_node, l layout) bool {
+    for _, c := range n.children {
+        if !is_toml_table(c, l) && !is_toml_table_array(c, l) {
+            return true
+        }
+    }
+    return false
+}
+
+// toml_header_line writes a table header with its comments, after a blank
+// line unless the file had none there
+func toml_header_line(sb *strings.Builder, header string, cm comment, tight bool) {
+    if sb.Len() > 0 && !tight && !strings.HasSuffix(sb.String(), "\n\n") {
+        sb.WriteString("\n")
+    }
+    write_comment(sb, cm.head, "")
+    sb.WriteString(line_comment(header, cm.line) + "\n")
+}
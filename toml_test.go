@@ -0,0 +1,76 @@
+package carver
+
+import (
+    "testing"
+)
+
+func TestTomlRoundTrip(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "scalars": {
+            "title = \"app\"\nport = 8080\nratio = 1.0\nbig = 9007199254740993\nexp = 1e+30\nok = true\n",
+            "title = \"app\"\nport = 8080\nratio = 1.0\nbig = 9007199254740993\nexp = 1e+30\nok = true\n",
+        },
+        "datetimes": {
+            "at = 1979-05-27T07:32:00Z\noffset = 1979-05-27T00:32:00.999-07:00\nlocal = 1979-05-27T07:32:00\nday = 1979-05-27\ntime = 07:32:00\n",
+            "at = 1979-05-27T07:32:00Z\noffset = 1979-05-27T00:32:00.999-07:00\nlocal = 1979-05-27T07:32:00\nday = 1979-05-27\ntime = 07:32:00\n",
+        },
+        "tables": {
+            "name = \"x\"\n\n[server]\nhost = \"a\"\n\n[server.tls]\nport = 443\n\n[a.b]\nc = 1\n",
+            "name = \"x\"\n\n[server]\nhost = \"a\"\n\n[server.tls]\nport = 443\n\n[a.b]\nc = 1\n",
+        },
+        "inline_and_arrays": {
+            "point = { x = 1, y = 2 }\nports = [8000, 8001]\nempty = {}\nnone = []\n\"log.level\" = \"info\"\n",
+            "point = { x = 1, y = 2 }\nports = [8000, 8001]\nempty = {}\nnone = []\n\"log.level\" = \"info\"\n",
+        },
+        "array_of_tables": {
+            "[[products]]\nname = \"Hammer\"\nsku = 738594937\n\n[[products]]\nname = \"Nail\"\ncolor = \"gray\"\n",
+            "[[products]]\nname = \"Hammer\"\nsku = 738594937\n\n[[products]]\nname = \"Nail\"\ncolor = \"gray\"\n",
+        },
+        "comments": {
+            "# app config\n\n# the name\nname = \"x # not a comment\" # kept\nports = [\n  8000, # dropped\n  8001,\n]\n\n# the server\n[server] # header\nhost = \"a\"\n\n# first\n[[products]]\nname = \"Hammer\" # hard\n\n# the end\n",
+            "# app config\n\n# the name\nname = \"x # not a comment\" # kept\nports = [8000, 8001]\n\n# the server\n[server] # header\nhost = \"a\"\n\n# first\n[[products]]\nname = \"Hammer\" # hard\n\n# the end\n",
+        },
+        "tight_headers": {
+            "[[items]]\nname = \"a\"\n[[items]]\nname = \"b\"\n# c\n[[items]]\nname = \"c\"\n\n[server]\nhost = \"a\"\n[server.tls]\nport = 443\n",
+            "[[items]]\nname = \"a\"\n[[items]]\nname = \"b\"\n# c\n[[items]]\nname = \"c\"\n\n[server]\nhost = \"a\"\n[server.tls]\nport = 443\n",
+        },
+        "comment_only_table": {
+            "# parent\n[a]\n\n[a.b]\nc = 1\n",
+            "# parent\n[a]\n\n[a.b]\nc = 1\n",
+        },
+    }
+    f := func(in string) string {
+        obj, err := decode_toml([]byte(in))
+        if err != nil {
+            return err.Error()
+        }
+        flattened, _ := flatten(obj, nil)
+        b, err := encode_file(flattened, toml_layout([]byte(in)).rekey(obj, nil), toml_codec{})
+        if err != nil {
+            return err.Error()
+        }
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestTomlTypes(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "int": {"v = 1", "int"},
+        "float": {"v = 1.0", "number"},
+        "datetime": {"v = 1979-05-27", "datetime"},
+        "string": {"v = \"1979-05-27\"", "string"},
+    }
+    f := func(in string) string {
+        obj, _ := decode_toml([]byte(in))
+        return type_to_string(obj["v"])
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestEncodeTomlNull(t * testing.T) {
+    _, err := encode_file(map[string]interface{}{"/a/b": nil}, toml_codec{}.default_layout(), toml_codec{})
+    if err == nil || err.Error() != "/a/b: toml has no null" {
+        t.Fatalf(`expected an error for null, got %v`, err)
+    }
+}
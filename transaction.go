@@ -0,0 +1,211 @@
+package carver
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// the names of staged files and backups, which sit next to their targets
+// until a transaction ends
+const (
+    staged_infix = ".carver-tmp-"
+    backup_infix = ".carver-backup-"
+)
+
+// a staged_file is a write or removal waiting for its transaction to commit.
+// a removal has no temp file.
+type staged_file struct {
+    target string
+    temp string
+    backup string
+    // root is the directory a removal may empty out, up to which its empty
+    // parents are removed
+    root string
+}
+
+// a transaction stages every file of a run next to its target and only moves
+// them into place once they've all been staged, so a run that fails partway
+// leaves the tree as it was. the files it replaces or removes are backed up
+// until it commits, so that a rename that fails rolls back the ones before it.
+type transaction struct {
+    files []staged_file
+    // dirs are the directories staging created, which are removed again if
+    // the transaction doesn't commit
+    dirs []string
+}
+
+// is_carver_file reports whether a file is one carver keeps for itself, which
+// is never read as a config file
+func is_carver_file(name string) bool {
+    return name == manifest_name || strings.Contains(name, staged_infix) || strings.Contains(name, backup_infix)
+}
+
+// temp_file creates an empty file next to a target, named after it
+func temp_file(target string, infix string) (string, error) {
+    f, err := os.CreateTemp(filepath.Dir(target), "." + filepath.Base(target) + infix + "*")
+    if err != nil {
+        return "", err
+    }
+    return f.Name(), f.Close()
+}
+
+// mkdir_all creates a directory and its parents, recording the ones it made
+func (t * transaction) mkdir_all(dir string) error {
+    missing := []string{}
+    for d := dir; ; d = filepath.Dir(d) {
+        if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+            break
+        }
+        missing = append(missing, d)
+    }
+    err := os.MkdirAll(dir, 0750)
+    for i := len(missing) - 1; i >= 0; i-- {
+        t.dirs = append(t.dirs, missing[i])
+    }
+    return err
+}
+
+// write stages the new contents of a file. a file that exists keeps its mode.
+func (t * transaction) write(target string, b []byte) error {
+    err := t.mkdir_all(filepath.Dir(target))
+    if err != nil {
+        return err
+    }
+    mode := os.FileMode(0644)
+    if info, err := os.Stat(target); err == nil {
+        mode = info.Mode().Perm()
+    }
+    temp, err := temp_file(target, staged_infix)
+    if err != nil {
+        return err
+    }
+    t.files = append(t.files, staged_file{target: target, temp: temp})
+    f, err := os.OpenFile(temp, os.O_WRONLY, 0)
+    if err != nil {
+        return err
+    }
+    _, err = f.Write(b)
+    if err == nil {
+        err = f.Sync()
+    }
+    close_err := f.Close()
+    if err == nil {
+        err = close_err
+    }
+    if err == nil {
+        err = os.Chmod(temp, mode)
+    }
+    return err
+}
+
+// remove stages the removal of a file under root
+func (t * transaction) remove(root string, target string) {
+    t.files = append(t.files, staged_file{target: target, root: root})
+}
+
+// backup keeps a copy of a file that is about to be replaced or removed, or
+// returns "" if there's no file
+func backup(target string) (string, error) {
+    old, err := os.ReadFile(target)
+    if os.IsNotExist(err) {
+        return "", nil
+    }
+    if err != nil {
+        return "", err
+    }
+    name, err := temp_file(target, backup_infix)
+    if err != nil {
+        return "", err
+    }
+    info, err := os.Stat(target)
+    if err == nil {
+        err = os.WriteFile(name, old, info.Mode().Perm())
+    }
+    if err != nil {
+        os.Remove(name)
+        return "", err
+    }
+    return name, nil
+}
+
+// commit moves the staged files into place. if a rename fails, the files
+// moved before it are restored from their backups and the error is returned.
+func (t * transaction) commit() error {
+    var err error
+    done := 0
+    for ; done < len(t.files); done++ {
+        f := &t.files[done]
+        f.backup, err = backup(f.target)
+        if err != nil {
+            break
+        }
+        if f.temp != "" {
+            err = os.Rename(f.temp, f.target)
+        } else if f.backup != "" {
+            err = os.Remove(f.target)
+        }
+        if err != nil {
+            break
+        }
+    }
+    if err != nil {
+        // the file that failed may have a backup, but its target is untouched
+        if done < len(t.files) && t.files[done].backup != "" {
+            os.Remove(t.files[done].backup)
+        }
+        return error_list{}.add(err).add(t.rollback(done)).err()
+    }
+    for _, f := range t.files {
+        if f.backup != "" {
+            os.Remove(f.backup)
+        }
+        if f.temp == "" {
+            remove_empty_dirs(f.root, f.target)
+        }
+    }
+    t.files = nil
+    t.dirs = nil
+    return nil
+}
+
+// rollback restores the first done files from their backups and cleans up
+// the rest of the transaction. a backup that can't be restored is left in
+// place.
+func (t * transaction) rollback(done int) error {
+    errs := error_list{}
+    for i := done - 1; i >= 0; i-- {
+        f := t.files[i]
+        if f.backup != "" {
+            errs = errs.add(os.Rename(f.backup, f.target))
+        } else if f.temp != "" {
+            errs = errs.add(os.Remove(f.target))
+        }
+    }
+    t.abort()
+    return errs.err()
+}
+
+// abort drops everything the transaction staged, leaving the targets alone
+func (t * transaction) abort() {
+    for _, f := range t.files {
+        if f.temp != "" {
+            os.Remove(f.temp)
+        }
+    }
+    for i := len(t.dirs) - 1; i >= 0; i-- {
+        os.Remove(t.dirs[i])
+    }
+    t.files = nil
+    t.dirs = nil
+}
+
+// remove_empty_dirs removes the parents of a removed file that it left empty,
+// up to root
+func remove_empty_dirs(root string, target string) {
+    for d := filepath.Dir(target); d != filepath.Clean(root) && d != filepath.Dir(d); d = filepath.Dir(d) {
+        if os.Remove(d) != nil {
+            break
+        }
+    }
+}
@@ -0,0 +1,115 @@
+package carver
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+// dir_contents lists the files under dir with their contents
+func dir_contents(dir string) map[string]string {
+    contents := map[string]string{}
+    filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+        rel, _ := filepath.Rel(dir, p)
+        if info.IsDir() {
+            contents[filepath.ToSlash(rel) + "/"] = ""
+            return nil
+        }
+        b, _ := os.ReadFile(p)
+        contents[filepath.ToSlash(rel)] = string(b)
+        return nil
+    })
+    return contents
+}
+
+func TestTransaction(t * testing.T) {
+    type step struct {
+        write map[string]string
+        remove []string
+        commit bool
+    }
+    testCases := map[string]testCaseOneArg[step, map[string]string]{
+        "commit": {
+            step{map[string]string{"a.json": "new", "b/c.json": "new"}, []string{"old/x.json"}, true},
+            map[string]string{"./": "", "a.json": "new", "b/": "", "b/c.json": "new", "keep.json": "old"},
+        },
+        "abort": {
+            step{map[string]string{"a.json": "new", "b/c.json": "new"}, []string{"old/x.json"}, false},
+            map[string]string{"./": "", "a.json": "old", "keep.json": "old", "old/": "", "old/x.json": "old"},
+        },
+        "rollback": {
+            step{map[string]string{"a.json": "new", "d/e.json": "new"}, []string{"old/x.json"}, true},
+            map[string]string{"./": "", "a.json": "old", "keep.json": "old", "old/": "", "old/x.json": "old"},
+        },
+    }
+    f := func(s step) map[string]string {
+        dir := t.TempDir()
+        os.MkdirAll(filepath.Join(dir, "old"), 0750)
+        for _, name := range []string{"a.json", "keep.json", "old/x.json"} {
+            os.WriteFile(filepath.Join(dir, name), []byte("old"), 0666)
+        }
+        tx := transaction{}
+        names := []string{}
+        for name := range s.write {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            tx.write(filepath.Join(dir, name), []byte(s.write[name]))
+        }
+        for _, name := range s.remove {
+            tx.remove(dir, filepath.Join(dir, name))
+        }
+        if _, ok := s.write["d/e.json"]; ok {
+            // a directory where the staged file should go makes the commit
+            // fail after a.json was moved into place
+            os.MkdirAll(filepath.Join(dir, "d", "e.json", "f"), 0750)
+            defer os.RemoveAll(filepath.Join(dir, "d"))
+        }
+        if s.commit {
+            tx.commit()
+        } else {
+            tx.abort()
+        }
+        contents := dir_contents(dir)
+        delete(contents, "d/")
+        delete(contents, "d/e.json/")
+        delete(contents, "d/e.json/f/")
+        return contents
+    }
+    runTestsOneArgParallel[step, map[string]string](t, f, testCases)
+}
+
+func TestTransactionKeepsMode(t * testing.T) {
+    dir := t.TempDir()
+    file_path := filepath.Join(dir, "a.json")
+    os.WriteFile(file_path, []byte("old"), 0600)
+    os.Chmod(file_path, 0600)
+    tx := transaction{}
+    tx.write(file_path, []byte("new"))
+    tx.write(filepath.Join(dir, "b.json"), []byte("new"))
+    err := tx.commit()
+    if err != nil {
+        t.Fatal(err)
+    }
+    modes := []os.FileMode{}
+    for _, name := range []string{"a.json", "b.json"} {
+        info, _ := os.Stat(filepath.Join(dir, name))
+        modes = append(modes, info.Mode().Perm())
+    }
+    if !reflect.DeepEqual(modes, []os.FileMode{0600, 0644}) {
+        t.Errorf(`expected modes [0600 0644], got %v`, modes)
+    }
+}
+
+func TestIsCarverFile(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, bool]{
+        "manifest": {manifest_name, true},
+        "staged": {".app.json.carver-tmp-123", true},
+        "backup": {".app.json.carver-backup-123", true},
+        "config": {"app.json", false},
+    }
+    runTestsOneArgParallel[string, bool](t, is_carver_file, testCases)
+}
@@ -0,0 +1,960 @@
+package carver
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "path"
+    "os"
+    "io/fs"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+type vfile struct {
+    name string
+    root_path string
+    path string
+    obj map[string]interface{}
+    layout layout
+}
+
+type opts struct {
+    Dirs []string `json:"dirs"`
+    Files []string `json:"files"`
+    Layers map[string][]string `json:"layers"`
+    Subsets string `json:"subsets"`
+    Tombstones bool `json:"tombstones"`
+    Threshold interface{} `json:"threshold"`
+    Arrays map[string]string `json:"arrays"`
+    Include []string `json:"include"`
+    Exclude []string `json:"exclude"`
+    Filters map[string]file_filter `json:"filters"`
+    CopyUnmatched bool `json:"copy_unmatched"`
+}
+
+func (o opts) get_policy() (policy, error) {
+    pol := policy{tombstones: o.Tombstones}
+    threshold := ""
+    if o.Threshold != nil {
+        threshold = fmt.Sprint(o.Threshold)
+    }
+    err := pol.set_threshold(threshold)
+    return pol, err
+}
+
+// set_threshold parses "most", a percentage like "90%" or a fraction like 0.9
+func (pol * policy) set_threshold(threshold string) error {
+    threshold = strings.TrimSpace(threshold)
+    pol.most = false
+    pol.threshold = 0
+    if threshold == "" || threshold == "all" {
+        return nil
+    }
+    if threshold == "most" {
+        pol.most = true
+        return nil
+    }
+    scale := 1.0
+    if strings.HasSuffix(threshold, "%") {
+        threshold = strings.TrimSuffix(threshold, "%")
+        scale = 100
+    }
+    f, err := strconv.ParseFloat(threshold, 64)
+    if err != nil || f <= 0 || f / scale > 1 {
+        return fmt.Errorf("invalid threshold %q", threshold)
+    }
+    pol.threshold = f / scale
+    return nil
+}
+
+type dir struct {
+    name string
+    path string
+}
+
+// a root is a tree of config files in a file system, named dir in errors
+// and reports
+type root struct {
+    fsys fs.FS
+    dir string
+}
+
+// os_root reads a tree from disk
+func os_root(dir string) root {
+    return root{os.DirFS(dir), dir}
+}
+
+// sub_root is a directory within a root
+func (r root) sub_root(name string) (root, error) {
+    fsys, err := fs.Sub(r.fsys, name)
+    return root{fsys, path.Join(r.dir, name)}, err
+}
+
+// file_path names a file of the root in errors
+func (r root) file_path(name string) string {
+    return path.Join(r.dir, name)
+}
+
+// path_error names the file of an error of the file system after the root
+func (r root) path_error(err error) error {
+    var pe * fs.PathError
+    if errors.As(err, &pe) {
+        return &fs.PathError{Op: pe.Op, Path: r.file_path(pe.Path), Err: pe.Err}
+    }
+    return err
+}
+
+func (r root) read_file(name string) ([]byte, error) {
+    b, err := fs.ReadFile(r.fsys, name)
+    return b, r.path_error(err)
+}
+
+func (d dir) get_name() string {
+    return d.name
+}
+
+// list_files lists the files under a dir by their path relative to it, e.g.
+// "service1/db.yaml". the directories in skip hold other layers and are left
+// out, as are hidden directories.
+func (d dir) list_files(r root, skip map[string]bool) ([]string, error) {
+    file_paths := []string{}
+    err := fs.WalkDir(r.fsys, d.path, func(p string, e fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        rel := "."
+        if p != d.path {
+            rel = strings.TrimPrefix(p, d.path + "/")
+        }
+        if e.IsDir() {
+            if rel != "." && (skip[path.Join(d.path, rel)] || strings.HasPrefix(e.Name(), ".")) {
+                return fs.SkipDir
+            }
+            return nil
+        }
+        if !is_carver_file(e.Name()) {
+            file_paths = append(file_paths, rel)
+        }
+        return nil
+    })
+    return file_paths, r.path_error(err)
+}
+
+// a group is a root directory, the env directories and the tree they
+// form. nested env directories get a layer for every parent directory.
+// e.g. group{"project/", ["envA/","prod/envB/"], tree}
+
+// a file group is a root directory and the env files, which are all
+// versions of one document
+// e.g. file_group{"project/", "common.json", ["dev.json","prod.json"]}
+
+// a file map is a kv map from file_names -> []file_paths
+// e.g. service1.json -> [envA/service1.json, envB/service1.json]
+
+// the keymap type stores the mapping from object keys -> val types -> vals
+// -> files containing the vals
+// this allows us to index by key to get key info with fast performance.
+// a keymap stores the information of a file across all environments. you
+// can reconstruct a file in all environments with only the keymap file.
+// the only thing that's missing is the unpathed filename (e.g.
+// "service1.json"). you could just truncate one of the paths (e.g.
+// filename("envA/service1.json")) to get the name, but that's not as
+// elegant.
+// e.g. "service_name" -> "string" -> "foo" -> "envA/service1.json"
+
+// the monad type stores a keymap with a bind function
+
+// the layer type stores the tree of files that are stacked to produce an
+// env file. normalize moves each value to the highest layer shared by all
+// the envs below it, and resolve flattens the stacks back out.
+// e.g. "service1.json" -> "prod/service1.json" -> "prod/b/service1.json"
+
+// the keymap_group type stores a monad with an id. the id provides the
+// unpathed filename, which we can use to create the common file when
+// merging json.
+
+type group struct {
+    root root
+    dirs []dir
+    tree layer
+    subsets []layer
+    arrays array_strategies
+    filters file_filters
+}
+
+type file_group struct {
+    root root
+    common_name string
+    files []string
+    subsets []layer
+    arrays array_strategies
+}
+
+// subsets are stored by env name and only get file names in get_subsets
+type grouping interface {
+    get_file_map(include_root_files bool) (file_map, error)
+    get_layer(id string) layer
+    get_envs() []string
+    get_subsets(id string) []layer
+    add_subsets(subsets []layer)
+    find_subsets() []layer
+}
+
+// the name of a discovered subset lists its envs, e.g. "dev+staging"
+var subset_escaper = strings.NewReplacer("%", "%25", "+", "%2B", "/", "%2F")
+
+func subset_name(envs []string) string {
+    escaped := []string{}
+    for _, env := range envs {
+        escaped = append(escaped, subset_escaper.Replace(env))
+    }
+    return strings.Join(escaped, "+")
+}
+
+func parse_subset_name(name string, envs []string) (layer, bool) {
+    if !strings.Contains(name, "+") {
+        return layer{}, false
+    }
+    known := map[string]bool{}
+    for _, env := range envs {
+        known[env] = true
+    }
+    members := []string{}
+    for _, escaped := range strings.Split(name, "+") {
+        env, err := url.PathUnescape(escaped)
+        if err != nil || !known[env] {
+            return layer{}, false
+        }
+        members = append(members, env)
+    }
+    return new_subset(name, members), true
+}
+
+type file_map struct {
+    root root
+    paths map[string][]string
+    arrays array_strategies
+    // unmatched are the paths of the files that the filters left out
+    unmatched []string
+    // normalized is set for the files of a normalized tree, the only ones
+    // that may hold tombstones
+    normalized bool
+}
+
+func (fm file_map) add_file(name string, path string) {
+    v, ok := fm.paths[name]
+    if !ok {
+        fm.paths[name] = []string{}
+    }
+    fm.paths[name] = append(v, path)
+}
+
+// remove_files leaves the files at the given paths out of the file map
+func (fm file_map) remove_files(file_paths map[string]bool) {
+    for name, paths := range fm.paths {
+        kept := []string{}
+        for _, p := range paths {
+            if !file_paths[path.Clean(p)] {
+                kept = append(kept, p)
+            }
+        }
+        if len(kept) == 0 {
+            delete(fm.paths, name)
+        } else {
+            fm.paths[name] = kept
+        }
+    }
+}
+
+// remove_unknown_subdirs leaves out the files in subdirs of the root that
+// aren't layer dirs, unless the manifest lists them as common files carver
+// wrote. such a dir is most likely the dir of an env that was dropped from the
+// config, and its files would be copied into every env, so each is an error.
+func (fm file_map) remove_unknown_subdirs(common map[string]bool) error {
+    unknown := map[string]bool{}
+    for name, paths := range fm.paths {
+        for _, p := range paths {
+            if path.Clean(p) == name && strings.Contains(name, "/") && !common[name] {
+                unknown[name] = true
+            }
+        }
+    }
+    fm.remove_files(unknown)
+    errs := error_list{}
+    for _, name := range manifest_names(unknown) {
+        errs = errs.add(file_error{fm.root.file_path(name), 0, 0, errors.New("not in a dir of the config, nor a common file of the manifest; normalize again to update it")})
+    }
+    return errs.err()
+}
+
+func (fm * file_map) add_dir(d dir, skip map[string]bool, filters file_filters) error {
+    files, err := d.list_files(fm.root, skip)
+    for _, f_name := range files {
+        file_path := d.get_name() + "/" + f_name
+        if !filters.match(d.path, f_name) {
+            fm.unmatched = append(fm.unmatched, path.Clean(file_path))
+            continue
+        }
+        fm.add_file(f_name, file_path)
+    }
+    return err
+}
+
+
+func (g group) get_dirs() []dir {
+    return g.dirs
+}
+
+// get_layer names the layers of the env tree after the file id. e.g. the
+// "prod" layer of "service1.json" is "prod/service1.json" and the root layer
+// is "service1.json".
+func (g group) get_layer(id string) layer {
+    return g.tree.rename(func(name string) string {
+        return path.Join(name, id)
+    })
+}
+
+func (g group) get_envs() []string {
+    return g.tree.leaves()
+}
+
+func (g group) get_subsets(id string) []layer {
+    subsets := []layer{}
+    for _, s := range g.subsets {
+        subsets = append(subsets, s.rename(func(name string) string {
+            return path.Join(name, id)
+        }))
+    }
+    return subsets
+}
+
+func (g * group) add_subsets(subsets []layer) {
+    g.subsets = append(g.subsets, subsets...)
+}
+
+// find_subsets returns the discovered subsets that were written to the root
+func (g group) find_subsets() []layer {
+    subsets := []layer{}
+    entries, err := fs.ReadDir(g.root.fsys, ".")
+    if err != nil {
+        return subsets
+    }
+    for _, e := range entries {
+        s, ok := parse_subset_name(e.Name(), g.get_envs())
+        if ok && e.IsDir() {
+            subsets = append(subsets, s)
+        }
+    }
+    return subsets
+}
+
+// layer_dirs lists the directories of every layer below the root
+func (g group) layer_dirs() map[string]bool {
+    dirs := map[string]bool{}
+    for _, name := range append(g.tree.leaves(), g.tree.internal_names()...) {
+        dirs[name] = true
+    }
+    for _, s := range g.subsets {
+        dirs[s.name] = true
+    }
+    return dirs
+}
+
+// get_file_map lists the files of every dir, down through its subdirectories
+// but not into the dirs of other layers, e.g. "service1/db.yaml" of
+// "prod/service1/db.yaml". a dir that can't be read is an error, except for
+// the layer and env dirs of a normalized tree, which only exist when they
+// hold files.
+func (g group) get_file_map(include_root_files bool) (file_map, error) {
+    fm := file_map{g.root,map[string][]string{},g.arrays,nil,include_root_files}
+    skip := g.layer_dirs()
+    errs := error_list{}
+    for _, d := range g.get_dirs() {
+        err := fm.add_dir(d, skip, g.filters)
+        if include_root_files && errors.Is(err, fs.ErrNotExist) {
+            continue
+        }
+        errs = errs.add(err)
+    }
+    if include_root_files {
+        for _, name := range g.tree.internal_names() {
+            fm.add_dir(dir{name,name}, skip, g.filters)
+        }
+        for _, s := range g.subsets {
+            fm.add_dir(dir{s.name,s.name}, skip, g.filters)
+        }
+        errs = errs.add(fm.add_dir(dir{".","."}, skip, g.filters))
+        // stale files no longer belong to any env
+        m := read_root_manifest(g.root)
+        fm.remove_files(m.stale)
+        errs = errs.add(fm.remove_unknown_subdirs(m.common))
+    }
+    return fm, errs.err()
+}
+
+func (g file_group) get_layer(id string) layer {
+    file_names := []string{}
+    for _, f_name := range g.files {
+        file_names = append(file_names, path.Clean(f_name))
+    }
+    return new_layer(g.common_name, file_names)
+}
+
+// the env name of a listed file is the file name without its extension
+func (g file_group) get_envs() []string {
+    envs := []string{}
+    for _, f_name := range g.files {
+        f_name = path.Clean(f_name)
+        envs = append(envs, strings.TrimSuffix(f_name, path.Ext(f_name)))
+    }
+    return envs
+}
+
+// subset files take the extension of the common file, e.g. "non-prod.json"
+func (g file_group) get_subsets(id string) []layer {
+    env_files := map[string]string{}
+    for i, env := range g.get_envs() {
+        env_files[env] = path.Clean(g.files[i])
+    }
+    subsets := []layer{}
+    for _, s := range g.subsets {
+        subsets = append(subsets, s.rename(func(name string) string {
+            env_file, ok := env_files[name]
+            if ok && name != s.name {
+                return env_file
+            }
+            return name + path.Ext(g.common_name)
+        }))
+    }
+    return subsets
+}
+
+func (g * file_group) add_subsets(subsets []layer) {
+    g.subsets = append(g.subsets, subsets...)
+}
+
+func (g file_group) find_subsets() []layer {
+    subsets := []layer{}
+    entries, err := fs.ReadDir(g.root.fsys, ".")
+    if err != nil {
+        return subsets
+    }
+    ext := path.Ext(g.common_name)
+    for _, e := range entries {
+        if e.IsDir() || path.Ext(e.Name()) != ext {
+            continue
+        }
+        s, ok := parse_subset_name(strings.TrimSuffix(e.Name(), ext), g.get_envs())
+        if ok {
+            subsets = append(subsets, s)
+        }
+    }
+    return subsets
+}
+
+// every listed file is one environment of a single document, so the file map
+// has exactly one key: the common file. listed files that don't exist under
+// the root are skipped, just like env dirs that lack a file.
+func (g file_group) get_file_map(include_root_files bool) (file_map, error) {
+    fm := file_map{g.root,map[string][]string{},g.arrays,nil,include_root_files}
+    file_names := g.files
+    if include_root_files {
+        for _, s := range g.get_subsets(g.common_name) {
+            file_names = append(file_names, s.name)
+        }
+        file_names = append(file_names, g.common_name)
+    }
+    for _, f_name := range file_names {
+        f_name = path.Clean(f_name)
+        _, err := fs.Stat(g.root.fsys, f_name)
+        if err != nil {
+            continue
+        }
+        fm.add_file(g.common_name, f_name)
+    }
+    return fm, nil
+}
+
+func (fm file_map) load_path(name string) ([]vfile, error) {
+    paths, ok := fm.paths[name]
+    if ! ok {
+        paths = []string{}
+    }
+    return new_files(fm.root, paths, fm.arrays)
+}
+
+// get_keymap_group loads the files of a group. when a file can't be loaded
+// the error is carried by the monad of the group.
+func (fm file_map) get_keymap_group(name string) keymap_group {
+    fs, err := fm.load_path(name)
+    layouts := map[string]layout{}
+    for _, f := range fs {
+        layouts[f.name] = f.layout
+    }
+    km := new_keymap(fs, !fm.normalized)
+    km.err = error_list{}.add(err).add(km.err).err()
+    return keymap_group{name, km, layouts}
+}
+
+func (fm file_map) get_keys() []string {
+    keys := []string{}
+    for key := range fm.paths {
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+// get_keymap_groups loads the groups on a pool of jobs workers, sorted by
+// name. when ctx is done some groups may be left unloaded.
+func (fm file_map) get_keymap_groups(ctx context.Context, jobs int) []keymap_group {
+    keys := fm.get_keys()
+    sort.Strings(keys)
+    kmgs := make([]keymap_group, len(keys))
+    run_jobs(ctx, jobs, len(keys), func(i int) {
+        kmgs[i] = fm.get_keymap_group(keys[i])
+    })
+    return kmgs
+}
+
+// new_file reads a file. its errors name the file as root.dir/path and give
+// the line and column of syntax errors.
+func new_file(r root, path string, arrays array_strategies) (* vfile, error) {
+    file_path := r.file_path(path)
+    b, err := r.read_file(path)
+    if err != nil {
+        return nil, err
+    }
+    c, err := codec_for(path, b)
+    if err != nil {
+        return nil, file_error{file_path, 0, 0, err}
+    }
+    f := vfile{path, r.dir, path, map[string]interface{}{}, c.read_layout(b)}
+    f.obj, err = c.decode(b)
+    if err != nil {
+        return nil, c.decode_error(file_path, b, err)
+    }
+    f.layout = f.layout.rekey(f.obj, arrays)
+    return &f, nil
+}
+
+// load_opts reads .carver.yaml from the config directory
+func load_opts(r root) (opts, error) {
+    config_file := r.file_path(".carver.yaml")
+    var config opts
+    b, err := r.read_file(".carver.yaml")
+    if err != nil {
+        return config, err
+    }
+    c, err := codec_for(config_file, b)
+    if err != nil {
+        return config, file_error{config_file, 0, 0, err}
+    }
+    obj, err := c.decode(b)
+    if err != nil {
+        return config, c.decode_error(config_file, b, err)
+    }
+    b, _ = json.Marshal(obj)
+    err = json.Unmarshal(b, &config)
+    if err != nil {
+        return config, file_error{config_file, 0, 0, err}
+    }
+    return config, nil
+}
+
+func new_group(config opts, r root) (grouping, error) {
+    arrays, err := new_array_strategies(config.Arrays)
+    if err != nil {
+        return nil, err
+    }
+    var g grouping
+    if len(config.Files) > 0 {
+        common_name := "common" + path.Ext(config.Files[0])
+        g = &file_group{r,common_name,config.Files,[]layer{},arrays}
+    } else {
+        var config_paths []dir
+        for _, dstr := range config.Dirs {
+            dir_path := dstr
+            dir_obj := dir{dir_path,path.Clean(dir_path)}
+            config_paths = append(config_paths, dir_obj)
+        }
+        tree, err := new_layer_tree(".", config.Dirs)
+        if err != nil {
+            return nil, err
+        }
+        global := file_filter{config.Include, config.Exclude}
+        filters, err := new_file_filters(global, config.Filters, tree.leaves())
+        if err != nil {
+            return nil, err
+        }
+        g = &group{r,config_paths,tree,[]layer{},arrays,filters}
+    }
+    subsets, err := new_subsets(config.Layers, g.get_envs())
+    if err != nil {
+        return nil, err
+    }
+    g.add_subsets(subsets)
+    return g, nil
+}
+
+// new_subsets builds the subsets declared under "layers", sorted by name
+func new_subsets(layers map[string][]string, envs []string) ([]layer, error) {
+    known := map[string]bool{}
+    for _, env := range envs {
+        known[env] = true
+        for name := env; name != "."; name = path.Dir(name) {
+            if _, ok := layers[name]; ok {
+                return []layer{}, fmt.Errorf("layer %s has the same name as an env", name)
+            }
+        }
+    }
+    names := []string{}
+    for name := range layers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    subsets := []layer{}
+    for _, name := range names {
+        members := []string{}
+        for _, env := range layers[name] {
+            env = path.Clean(env)
+            if !known[env] {
+                return []layer{}, fmt.Errorf("layer %s lists unknown env %s", name, env)
+            }
+            members = append(members, env)
+        }
+        if len(members) == 0 {
+            continue
+        }
+        subsets = append(subsets, new_subset(name, members))
+    }
+    return subsets, nil
+}
+
+// discover_subsets looks for sets of envs that share values in every keymap
+// group, and turns the ones worth a file of their own into subsets
+func discover_subsets(g grouping, kmgs []keymap_group, pol policy) []layer {
+    envs := g.get_envs()
+    sets := [][]string{}
+    for _, kmg := range kmgs {
+        names := kmg.km.get_names()
+        full := g.get_layer(kmg.id)
+        env_names := map[string]string{}
+        for i, leaf := range full.leaves() {
+            env_names[leaf] = envs[i]
+        }
+        l := full.prune(names)
+        subsets := prune_subsets(g.get_subsets(kmg.id), names)
+        for _, set := range kmg.km.km.leaf_sets(l, subsets, pol) {
+            env_set := []string{}
+            for _, leaf := range set {
+                env_set = append(env_set, env_names[leaf])
+            }
+            sort.Strings(env_set)
+            sets = append(sets, env_set)
+        }
+    }
+    subsets := []layer{}
+    for _, set := range choose_subsets(sets, 2) {
+        subsets = append(subsets, new_subset(subset_name(set), set))
+    }
+    return subsets
+}
+
+// new_files reads every file it can and returns the errors of the rest
+func new_files(r root, file_paths []string, arrays array_strategies) ([]vfile, error) {
+    var fs []vfile
+    errs := error_list{}
+    for _, file_path := range file_paths {
+        file_path_absolute := path.Clean(file_path)
+        f, err := new_file(r, file_path_absolute, arrays)
+        if err != nil {
+            errs = errs.add(err)
+            continue
+        }
+        fs = append(fs, *f)
+    }
+    return fs, errs.err()
+}
+
+// new_keymap merges every file into one keymap. a file that can't be merged is
+// left out, and the errors of all of them end up in the monad. source files
+// are the files of a config tree, which can't hold tombstones.
+func new_keymap(files []vfile, source bool) monad {
+    m1 := monad{
+        nil,
+        make(keymap),
+        []string{},
+    }
+    errs := error_list{}
+    for _, f := range files {
+        args := []interface{}{f, source}
+        m2 := m1.bind(km_merge, args...)
+        if m2.err != nil {
+            errs = errs.add(m2.err)
+            continue
+        }
+        m1 = m2
+        m1.names = append(m1.names, f.name)
+    }
+    m1.err = errs.err()
+    return m1
+}
+
+// renderFiles encodes each flat object in the format of its file extension.
+// a file the sink already holds keeps its layout, otherwise it takes the
+// layout of the files it was built from.
+func renderFiles(sink Sink, output_dir string, filenames map[string]map[string]interface{}, layouts map[string]layout) (map[string][]byte, error) {
+    rendered := map[string][]byte{}
+    errs := error_list{}
+    for name, obj := range filenames {
+        file_path := path.Clean(output_dir + "/" + name)
+        l, ok := layouts[name]
+        c, err := layout_codec(name, l)
+        if err != nil {
+            errs = errs.add(file_error{file_path, 0, 0, err})
+            continue
+        }
+        if !ok {
+            l = c.default_layout()
+        }
+        b, err := sink.ReadFile(name)
+        if err == nil {
+            existing, _ := c.decode(b)
+            l = c.read_layout(b).rekey(existing, l.arrays).with_fallback(l)
+        }
+        b, err = encode_file(obj, l, c)
+        if err != nil {
+            errs = errs.add(file_error{file_path, 0, 0, err})
+            continue
+        }
+        rendered[name] = b
+    }
+    return rendered, errs.err()
+}
+
+// plan_files renders the files and compares them, and the files copied
+// through, with the ones the sink holds
+func plan_files(sink Sink, output_dir string, filenames map[string]map[string]interface{}, layouts map[string]layout, copies map[string][]byte) (Report, error) {
+    rendered, err := renderFiles(sink, output_dir, filenames, layouts)
+    for name, b := range copies {
+        if _, ok := filenames[name]; !ok {
+            rendered[name] = b
+        }
+    }
+    report := Report{}
+    for name, b := range rendered {
+        report = append(report, new_change(sink, name, path.Clean(output_dir + "/" + name), b))
+    }
+    report.sort()
+    return report, err
+}
+
+// writeFiles adds the files that changed to a commit, leaving the others
+// untouched so that their modification times stay put
+func writeFiles(c * commit, sink Sink, output_dir string, filenames map[string]map[string]interface{}, layouts map[string]layout, copies map[string][]byte) (Report, error) {
+    report, err := plan_files(sink, output_dir, filenames, layouts, copies)
+    for _, change := range report {
+        if change.changed() {
+            c.write(change.name, change.new)
+        }
+    }
+    return report, err
+}
+
+// get_policy applies the -threshold flag on top of the configuration
+func get_policy(config opts, threshold string) (policy, error) {
+    pol, err := config.get_policy()
+    if err != nil || threshold == "" {
+        return pol, err
+    }
+    err = pol.set_threshold(threshold)
+    return pol, err
+}
+
+// healthy_groups drops the keymap groups whose files couldn't all be loaded
+// and returns their errors. normalizing a group without one of its files
+// would move values the missing file doesn't share, so the whole group is
+// skipped.
+func healthy_groups(kmgs []keymap_group) ([]keymap_group, error) {
+    healthy := []keymap_group{}
+    errs := error_list{}
+    for _, kmg := range kmgs {
+        if kmg.km.err != nil {
+            errs = errs.add(kmg.km.err)
+            continue
+        }
+        healthy = append(healthy, kmg)
+    }
+    return healthy, errs.err()
+}
+
+// normalize_dir normalizes the config dir c and returns the files that belong
+// in the normalized dir, along with the layouts of the files they came from
+// and the common files among them. when a file can't be loaded the error lists every broken file, and with
+// keep_going the files of the other groups are returned as well. the groups
+// are loaded and normalized on a pool of jobs workers.
+func normalize_dir(ctx context.Context, config opts, pol policy, c root, keep_going bool, jobs int) (map[string]map[string]interface{}, map[string]layout, map[string]bool, []layer, error) {
+    filenames := map[string]map[string]interface{}{}
+    layouts := map[string]layout{}
+    common := map[string]bool{}
+    var suggested []layer
+    switch config.Subsets {
+    case "", "off", "suggest", "auto":
+    default:
+        return filenames, layouts, common, suggested, fmt.Errorf("unknown subsets mode %s", config.Subsets)
+    }
+    g, err := new_group(config, c)
+    if err != nil {
+        return filenames, layouts, common, suggested, err
+    }
+    fm, err := g.get_file_map(false)
+    if err != nil {
+        return filenames, layouts, common, suggested, err
+    }
+    all_kmgs := fm.get_keymap_groups(ctx, jobs)
+    if ctx.Err() != nil {
+        return filenames, layouts, common, suggested, ctx.Err()
+    }
+    kmgs, load_err := healthy_groups(all_kmgs)
+    if load_err != nil && !keep_going {
+        return filenames, layouts, common, suggested, load_err
+    }
+    switch config.Subsets {
+    case "suggest":
+        suggested = discover_subsets(g, kmgs, pol)
+    case "auto":
+        g.add_subsets(discover_subsets(g, kmgs, pol))
+    }
+    // the group is only read from here on, and each worker owns the keymap
+    // of its own keymap group
+    results := make([]map[string]map[string]interface{}, len(kmgs))
+    run_jobs(ctx, jobs, len(kmgs), func(i int) {
+        kmg := kmgs[i]
+        names := kmg.km.get_names()
+        l := g.get_layer(kmg.id).prune(names)
+        subsets := prune_subsets(g.get_subsets(kmg.id), names)
+        kmg_filenames := kmg.km.
+            bind(
+                normalize,
+                l,
+                subsets,
+                pol,
+            ).
+            km.to_files()
+        add_identities(kmg_filenames, fm.arrays)
+        results[i] = kmg_filenames
+    })
+    if ctx.Err() != nil {
+        return filenames, layouts, common, suggested, ctx.Err()
+    }
+    for i, kmg := range kmgs {
+        for name, obj := range results[i] {
+            filenames[name] = obj
+            layouts[name] = kmg.get_layout(name)
+        }
+        // the root layer of a keymap group is its common file
+        if name := g.get_layer(kmg.id).name; results[i][name] != nil {
+            common[name] = true
+        }
+    }
+    return filenames, layouts, common, suggested, load_err
+}
+
+// merge_dir merges the normalized dir n and returns the files that belong in
+// the config dir, along with the layouts of the files they came from. errors
+// are handled like in normalize_dir, and so are the jobs.
+func merge_dir(ctx context.Context, config opts, n root, keep_going bool, jobs int) (map[string]map[string]interface{}, map[string]layout, error) {
+    filenames := map[string]map[string]interface{}{}
+    layouts := map[string]layout{}
+    g, err := new_group(config, n)
+    if err != nil {
+        return filenames, layouts, err
+    }
+    g.add_subsets(g.find_subsets())
+    fm, err := g.get_file_map(true)
+    if err != nil {
+        return filenames, layouts, err
+    }
+    all_kmgs := fm.get_keymap_groups(ctx, jobs)
+    if ctx.Err() != nil {
+        return filenames, layouts, ctx.Err()
+    }
+    kmgs, load_err := healthy_groups(all_kmgs)
+    if load_err != nil && !keep_going {
+        return filenames, layouts, load_err
+    }
+    results := make([]map[string]map[string]interface{}, len(kmgs))
+    run_jobs(ctx, jobs, len(kmgs), func(i int) {
+        kmg := kmgs[i]
+        names := kmg.km.get_names()
+        l := g.get_layer(kmg.id)
+        subsets := g.get_subsets(kmg.id)
+        leaves := l.reachable(names)
+        for _, s := range subsets {
+            for _, name := range names {
+                if name == s.name {
+                    leaves = append(leaves, s.leaves()...)
+                }
+            }
+        }
+        l = l.prune(leaves)
+        subsets = prune_subsets(subsets, leaves)
+        results[i] = kmg.km.
+            bind(
+                resolve,
+                l,
+                subsets,
+            ).
+            km.to_files()
+    })
+    if ctx.Err() != nil {
+        return filenames, layouts, ctx.Err()
+    }
+    for i, kmg := range kmgs {
+        for name, obj := range results[i] {
+            filenames[name] = obj
+            layouts[name] = kmg.get_layout(name)
+        }
+    }
+    return filenames, layouts, load_err
+}
+
+// write_or_diff writes the files, and the files copied through, to a sink and
+// updates its manifest, or only plans the changes on a dry run. output_dir
+// names the files of the sink in the report. complete is unset when some files
+// couldn't be read, so nothing is pruned. the files are committed together:
+// if any of them can't be written, none are.
+func write_or_diff(sink Sink, output_dir string, filenames map[string]map[string]interface{}, layouts map[string]layout, copies map[string][]byte, common map[string]bool, dry_run bool, prune bool, complete bool) (Report, error) {
+    var report, deleted Report
+    var err, prune_err error
+    names := map[string]bool{}
+    for name := range filenames {
+        names[name] = true
+    }
+    for name := range copies {
+        names[name] = true
+    }
+    if dry_run {
+        report, err = plan_files(sink, output_dir, filenames, layouts, copies)
+        deleted, prune_err = plan_manifest(sink, output_dir, names, common, prune, complete)
+    } else {
+        c := commit{map[string][]byte{}, []string{}}
+        report, err = writeFiles(&c, sink, output_dir, filenames, layouts, copies)
+        deleted, prune_err = update_manifest(&c, sink, output_dir, names, common, prune, complete)
+        err = error_list{}.add(err).add(prune_err).err()
+        if err != nil {
+            return nil, err
+        }
+        err = sink.Commit(c.files, c.removed)
+        if err != nil {
+            return nil, err
+        }
+    }
+    report = append(report, deleted...)
+    report.sort()
+    return report, error_list{}.add(err).add(prune_err).err()
+}
@@ -0,0 +1,134 @@
+package carver
+
+import (
+    "os"
+    "path"
+    "path/filepath"
+    "testing"
+    "reflect"
+)
+
+func TestFileGroupGetFileMap(t * testing.T) {
+    config, _ := load_opts(os_root("test_stack/test1"))
+    g, _ := new_group(config, os_root("test_stack/test1"))
+    testCases := map[string]testCaseOneArg[bool, map[string][]string]{
+        "normalize": {
+            false,
+            map[string][]string{
+                "common.json": {"dev.json", "staging.json", "prod.json", "test.yaml"},
+            },
+        },
+        "merge": {
+            true,
+            map[string][]string{
+                "common.json": {"dev.json", "staging.json", "prod.json", "test.yaml"},
+            },
+        },
+    }
+    get_paths := func(include_root_files bool) map[string][]string {
+        fm, _ := g.get_file_map(include_root_files)
+        return fm.paths
+    }
+    runTestsOneArgParallel[bool, map[string][]string](t, get_paths, testCases)
+    l := g.get_layer("common.json")
+    if ! reflect.DeepEqual(l.leaves(), []string{"dev.json", "staging.json", "prod.json", "test.yaml"}) {
+        t.Fatalf(`expected 4 envs, got %v`, l.leaves())
+    }
+    normalized, _ := new_group(config, os_root("test_stack/test1/.carver"))
+    fm, _ := normalized.get_file_map(true)
+    expected := []string{"dev.json", "staging.json", "prod.json", "test.yaml", "common.json"}
+    if ! reflect.DeepEqual(expected, fm.paths["common.json"]) {
+        t.Fatalf(`expected %v, got %v`, expected, fm.paths["common.json"])
+    }
+}
+
+func TestParseSubsetName(t * testing.T) {
+    envs := []string{"dev", "staging", "prod/us-east"}
+    testCases := map[string]testCaseOneArg[string, layer]{
+        "pair": {
+            "dev+staging",
+            new_subset("dev+staging", []string{"dev", "staging"}),
+        },
+        "nested": {
+            subset_name([]string{"dev", "prod/us-east"}),
+            new_subset("dev+prod%2Fus-east", []string{"dev", "prod/us-east"}),
+        },
+        "unknown": {
+            "dev+qa",
+            layer{},
+        },
+        "env": {
+            "dev",
+            layer{},
+        },
+    }
+    f := func(name string) layer {
+        s, _ := parse_subset_name(name, envs)
+        return s
+    }
+    runTestsOneArgParallel[string, layer](t, f, testCases)
+}
+
+func TestSetThreshold(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, policy]{
+        "empty": {"", policy{}},
+        "all": {"all", policy{}},
+        "most": {"most", policy{most: true}},
+        "percentage": {"90%", policy{threshold: 0.9}},
+        "fraction": {"0.5", policy{threshold: 0.5}},
+        "invalid": {"150%", policy{}},
+    }
+    f := func(threshold string) policy {
+        pol := policy{}
+        pol.set_threshold(threshold)
+        return pol
+    }
+    runTestsOneArgParallel[string, policy](t, f, testCases)
+}
+
+func TestGroupGetFileMapNested(t * testing.T) {
+    config, _ := load_opts(os_root("test_stack/test5"))
+    testCases := map[string]testCaseTwoArgs[string, bool, map[string][]string]{
+        "config": {
+            "test_stack/test5",
+            false,
+            map[string][]string{
+                "k8s/deployment.json": {"dev/k8s/deployment.json", "prod/us/k8s/deployment.json", "prod/eu/k8s/deployment.json"},
+                "service1/db.yaml": {"dev/service1/db.yaml", "prod/us/service1/db.yaml", "prod/eu/service1/db.yaml"},
+            },
+        },
+        "normalized": {
+            "test_stack/test5/.carver",
+            true,
+            map[string][]string{
+                "k8s/deployment.json": {"dev/k8s/deployment.json", "prod/eu/k8s/deployment.json", "prod/k8s/deployment.json", "k8s/deployment.json"},
+                "service1/db.yaml": {"dev/service1/db.yaml", "prod/us/service1/db.yaml", "prod/eu/service1/db.yaml", "prod/service1/db.yaml", "service1/db.yaml"},
+            },
+        },
+    }
+    get_paths := func(root string, include_root_files bool) map[string][]string {
+        g, _ := new_group(config, os_root(root))
+        fm, _ := g.get_file_map(include_root_files)
+        paths := map[string][]string{}
+        for name, file_paths := range fm.paths {
+            for _, file_path := range file_paths {
+                paths[name] = append(paths[name], path.Clean(file_path))
+            }
+        }
+        return paths
+    }
+    runTestsTwoArgsParallel[string, bool, map[string][]string](t, get_paths, testCases)
+}
+
+func TestListFiles(t * testing.T) {
+    root := t.TempDir()
+    for _, name := range []string{"dev/a.json", "dev/svc/b.json", "dev/.git/config", "dev/eu/c.json", "dev/.a.json.carver-tmp-1"} {
+        os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0750)
+        os.WriteFile(filepath.Join(root, name), []byte("{}"), 0666)
+    }
+    files, err := dir{"dev", "dev"}.list_files(os_root(root), map[string]bool{"dev/eu": true})
+    expected := []string{"a.json", "svc/b.json"}
+    if err != nil || !reflect.DeepEqual(files, expected) {
+        t.Fatalf(`expected %v, got %v (%v)`, expected, files, err)
+    }
+}
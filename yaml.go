@@ -0,0 +1,266 @@
+package carver
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "encoding/json"
+    "gopkg.in/yaml.v3"
+)
+
+// an anchor is how a yaml value is shared: the anchor it defines, the anchor
+// it's an alias of, and the anchors its mapping merges with <<
+type anchor struct {
+    name string
+    alias string
+    merges []string
+}
+
+// decode_yaml decodes a yaml document with the same parser that reads its
+// layout. numbers are kept as json.Number, and dates as the text they're
+// written as.
+func decode_yaml(b []byte) (map[string]interface{}, error) {
+    var doc yaml.Node
+    err := yaml.Unmarshal(b, &doc)
+    if err != nil {
+        return map[string]interface{}{}, err
+    }
+    if len(doc.Content) == 0 {
+        return map[string]interface{}{}, nil
+    }
+    root := doc.Content[0]
+    if root.Kind != yaml.MappingNode {
+        return map[string]interface{}{}, fmt.Errorf("yaml: line %d: the document is not a mapping", root.Line)
+    }
+    v, err := yaml_value(root)
+    if err != nil {
+        return map[string]interface{}{}, err
+    }
+    return v.(map[string]interface{}), nil
+}
+
+func yaml_value(n *yaml.Node) (interface{}, error) {
+    switch n.Kind {
+    case yaml.AliasNode:
+        return yaml_value(n.Alias)
+    case yaml.MappingNode:
+        obj := map[string]interface{}{}
+        merged := map[string]interface{}{}
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            key := n.Content[i]
+            value := n.Content[i+1]
+            v, err := yaml_value(value)
+            if err != nil {
+                return nil, err
+            }
+            if key.ShortTag() != "!!merge" {
+                obj[key.Value] = v
+                continue
+            }
+            // the keys of the mapping win over merged ones, and earlier
+            // merges over later ones
+            sources := []interface{}{v}
+            if value.Kind == yaml.SequenceNode {
+                sources = v.([]interface{})
+            }
+            for _, source := range sources {
+                m, ok := source.(map[string]interface{})
+                if !ok {
+                    return nil, fmt.Errorf("yaml: line %d: << merges a value that is not a mapping", value.Line)
+                }
+                for k, mv := range m {
+                    if _, ok := merged[k]; !ok {
+                        merged[k] = mv
+                    }
+                }
+            }
+        }
+        for k, v := range merged {
+            if _, ok := obj[k]; !ok {
+                obj[k] = v
+            }
+        }
+        return obj, nil
+    case yaml.SequenceNode:
+        items := []interface{}{}
+        for _, c := range n.Content {
+            v, err := yaml_value(c)
+            if err != nil {
+                return nil, err
+            }
+            items = append(items, v)
+        }
+        return items, nil
+    }
+    switch n.ShortTag() {
+    case "!!null":
+        return nil, nil
+    case "!!bool":
+        var v bool
+        err := n.Decode(&v)
+        return v, err
+    case "!!int", "!!float":
+        if json_number.MatchString(n.Value) {
+            return json.Number(n.Value), nil
+        }
+        // numbers json can't write, like 0755 or .5, are carried by value
+        var v interface{}
+        err := n.Decode(&v)
+        if err != nil {
+            return nil, err
+        }
+        f, ok := v.(float64)
+        if !ok {
+            return json.Number(fmt.Sprint(v)), nil
+        }
+        if math.IsInf(f, 0) || math.IsNaN(f) {
+            return nil, fmt.Errorf("yaml: line %d: %s can't be carried as a number", n.Line, n.Value)
+        }
+        return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+    }
+    return n.Value, nil
+}
+
+// yaml_styles records the scalars of a yaml document that carver would write
+// differently, like 0755, yes or 'quoted', so they're written back as they
+// were while their values don't change
+func yaml_styles(n *yaml.Node, prefix string, lines []string, styles map[string]style) {
+    switch n.Kind {
+    case yaml.DocumentNode:
+        for _, c := range n.Content {
+            yaml_styles(c, prefix, lines, styles)
+        }
+    case yaml.MappingNode:
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            if n.Content[i].ShortTag() == "!!merge" {
+                continue
+            }
+            yaml_styles(n.Content[i+1], join_path(prefix, n.Content[i].Value), lines, styles)
+        }
+    case yaml.SequenceNode:
+        for i, c := range n.Content {
+            yaml_styles(c, join_path(prefix, strconv.Itoa(i)), lines, styles)
+        }
+    case yaml.ScalarNode:
+        v, err := yaml_value(n)
+        if err != nil {
+            return
+        }
+        raw := yaml_raw(n, lines)
+        if raw != "" && raw != yaml_scalar(v, "") {
+            styles[prefix] = style{"", "", "", raw, json_scalar(v)}
+        }
+    }
+}
+
+// yaml_raw is the text of a scalar on its line, with its tag but without its
+// anchor. scalars spanning several lines have none.
+func yaml_raw(n *yaml.Node, lines []string) string {
+    if n.Style & (yaml.LiteralStyle | yaml.FoldedStyle) != 0 || n.Line < 1 || n.Line > len(lines) {
+        return ""
+    }
+    line := []rune(lines[n.Line-1])
+    if n.Column < 1 || n.Column > len(line) {
+        return ""
+    }
+    text := string(line[n.Column-1:])
+    props := []string{}
+    for strings.HasPrefix(text, "&") || strings.HasPrefix(text, "!") {
+        token, rest, _ := strings.Cut(text, " ")
+        if token != "&" + n.Anchor {
+            props = append(props, token)
+        }
+        text = strings.TrimLeft(rest, " ")
+    }
+    end := len(text)
+    switch {
+    case strings.HasPrefix(text, "'"):
+        end = strings.Index(strings.ReplaceAll(text[1:], "''", "  "), "'")
+        if end >= 0 {
+            end += 2
+        }
+    case strings.HasPrefix(text, "\""):
+        end = -1
+        for i := 1; i < len(text); i++ {
+            if text[i] == '\\' {
+                i++
+            } else if text[i] == '"' {
+                end = i + 1
+                break
+            }
+        }
+    default:
+        if i := strings.Index(text, " #"); i >= 0 {
+            end = i
+        }
+        // the end of an item of a flow mapping or sequence. a block scalar
+        // cut short here fails the check below.
+        if i := strings.IndexAny(text, ",]}"); i >= 0 && i < end {
+            end = i
+        }
+    }
+    if end < 1 {
+        return ""
+    }
+    raw := strings.Join(append(props, strings.TrimRight(text[:end], " ")), " ")
+    // a scalar that goes on past its line doesn't read back the same
+    var check yaml.Node
+    if yaml.Unmarshal([]byte(raw), &check) != nil || len(check.Content) == 0 {
+        return ""
+    }
+    v, err := yaml_value(check.Content[0])
+    want, _ := yaml_value(n)
+    if err != nil || json_scalar(v) != json_scalar(want) {
+        return ""
+    }
+    return raw
+}
+
+// yaml_anchors records the anchors and aliases of the values of a yaml
+// document, and the anchors its mappings merge
+func yaml_anchors(n *yaml.Node, prefix string, anchors map[string]anchor) {
+    switch n.Kind {
+    case yaml.DocumentNode:
+        for _, c := range n.Content {
+            yaml_anchors(c, prefix, anchors)
+        }
+    case yaml.MappingNode:
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            key := n.Content[i]
+            value := n.Content[i+1]
+            if key.ShortTag() != "!!merge" {
+                yaml_anchor(value, join_path(prefix, key.Value), anchors)
+                continue
+            }
+            a := anchors[prefix]
+            sources := []*yaml.Node{value}
+            if value.Kind == yaml.SequenceNode {
+                sources = value.Content
+            }
+            for _, source := range sources {
+                if source.Kind == yaml.AliasNode {
+                    a.merges = append(a.merges, source.Value)
+                }
+            }
+            anchors[prefix] = a
+        }
+    case yaml.SequenceNode:
+        for i, c := range n.Content {
+            yaml_anchor(c, join_path(prefix, strconv.Itoa(i)), anchors)
+        }
+    }
+}
+
+func yaml_anchor(n *yaml.Node, p string, anchors map[string]anchor) {
+    if n.Kind == yaml.AliasNode {
+        anchors[p] = anchor{"", n.Value, nil}
+        return
+    }
+    if n.Anchor != "" {
+        a := anchors[p]
+        a.name = n.Anchor
+        anchors[p] = a
+    }
+    yaml_anchors(n, p, anchors)
+}
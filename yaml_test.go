@@ -0,0 +1,89 @@
+package carver
+
+import (
+    "testing"
+)
+
+func TestYamlRoundTrip(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "scalars": {
+            "version: 1.10\nmode: 0755\nflag: yes\nnone: ~\nname: \"quoted\"\nsingle: 'it''s'\nday: 2001-12-14\nhex: 0x1F\ntagged: !!str 5\ny: 1\n",
+            "version: 1.10\nmode: 0755\nflag: yes\nnone: ~\nname: \"quoted\"\nsingle: 'it''s'\nday: 2001-12-14\nhex: 0x1F\ntagged: !!str 5\ny: 1\n",
+        },
+        "flow": {
+            "ports: [0x50, \"443\"]\nflags: {on: yes, off: 'no'}\n",
+            "ports: [0x50, \"443\"]\nflags: {on: yes, off: 'no'}\n",
+        },
+        "anchors": {
+            "base: &b\n  x: 1\n  y: two\nderived:\n  <<: *b\n  y: 3\nagain: *b\nlist:\n  - &i item # first\n  - *i\n",
+            "base: &b\n  x: 1\n  y: two\nderived:\n  <<: *b\n  y: 3\nagain: *b\nlist:\n  - &i item # first\n  - *i\n",
+        },
+        "merge_list": {
+            "a: &a {x: 1}\nb: &b {x: 2, y: 2}\nc:\n  <<: [*a, *b]\n",
+            "a: &a {x: 1}\nb: &b {x: 2, y: 2}\nc:\n  <<: [*a, *b]\n",
+        },
+        "anchored_items": {
+            "list:\n  - &web\n    name: web\n  - *web\n",
+            "list:\n  - &web\n    name: web\n  - *web\n",
+        },
+    }
+    f := func(in string) string {
+        obj, err := decode_yaml([]byte(in))
+        if err != nil {
+            return err.Error()
+        }
+        flattened, _ := flatten(obj, nil)
+        b, _ := encode_file(flattened, yaml_codec{}.read_layout([]byte(in)).rekey(obj, nil), yaml_codec{})
+        return string(b)
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}
+
+func TestYamlChangedValues(t * testing.T) {
+    in := "mode: 0755\nbase: &b\n  x: 1\n  y: 2\nderived:\n  <<: *b\n  y: 3\nagain: *b\n"
+    testCases := map[string]testCaseOneArg[map[string]interface{}, string]{
+        "changed_scalar": {
+            map[string]interface{}{"/mode": "0644"},
+            "mode: \"0644\"\n",
+        },
+        "changed_alias": {
+            map[string]interface{}{"/base/x": 1, "/base/y": 2, "/again/x": 1, "/again/y": 5},
+            "base: &b\n  x: 1\n  y: 2\nagain:\n  x: 1\n  y: 5\n",
+        },
+        "dropped_merged_key": {
+            map[string]interface{}{"/base/x": 1, "/base/y": 2, "/derived/y": 3},
+            "base: &b\n  x: 1\n  y: 2\nderived:\n  y: 3\n",
+        },
+        "merge_without_anchor": {
+            map[string]interface{}{"/derived/x": 1, "/derived/y": 3},
+            "derived:\n  y: 3\n  x: 1\n",
+        },
+    }
+    f := func(obj map[string]interface{}) string {
+        existing, _ := decode_yaml([]byte(in))
+        b, _ := encode_file(obj, yaml_codec{}.read_layout([]byte(in)).rekey(existing, nil), yaml_codec{})
+        return string(b)
+    }
+    runTestsOneArgParallel[map[string]interface{}, string](t, f, testCases)
+}
+
+func TestYamlTypes(t * testing.T) {
+    testCases := map[string]testCaseOneArg[string, string]{
+        "yes": {"v: yes", "\"yes\""},
+        "octal": {"v: 0755", "493"},
+        "decimal": {"v: 1.10", "1.10"},
+        "null": {"v: ~", "null"},
+        "date": {"v: 2001-12-14", "\"2001-12-14\""},
+        "merge": {"a: &a {x: 1, y: 1}\nv:\n  <<: *a\n  y: 2", "{\"x\":1,\"y\":2}"},
+        "infinity": {"v: .inf", "yaml: line 1: .inf can't be carried as a number"},
+        "not_a_mapping": {"- a", "yaml: line 1: the document is not a mapping"},
+    }
+    f := func(in string) string {
+        obj, err := decode_yaml([]byte(in))
+        if err != nil {
+            return err.Error()
+        }
+        return json_scalar(obj["v"])
+    }
+    runTestsOneArgParallel[string, string](t, f, testCases)
+}